@@ -1,18 +1,37 @@
 package catapult
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/zencoder/disque-go/disque"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"catapult/lock"
+	"catapult/logger"
+	"catapult/metrics"
 	"catapult/queue"
+	"catapult/store"
 )
 
+// ErrNoRedis is the error thrown when a redis connection is required but not provided
+var ErrNoRedis = errors.New("Catapult Error: no redis connection is provided!")
+
+// JobLockDuration is the duration of the locks on the jobs being processed, which
+// are renewed at half of it while the job runs
+var JobLockDuration = lock.DefaultDuration
+
 var (
-	// CatapultCMDStopProcessing is the command for stopping the processing routine
+	// CatapultCMDStopProcessing is the command for stopping the processing of all queues
 	CatapultCMDStopProcessing = "STOPProc"
 	// CatapultSignalStopProcSuccess signals the success of the stop command
 	CatapultSignalStopProcSuccess = "STOPProcSuccess"
@@ -21,173 +40,542 @@ var (
 // DelegateFunction defines the signature of a delegate function
 type DelegateFunction func(*queue.Job, string, *Catapult) interface{}
 
+// HandlerFunction defines the signature of a context aware handler function
+//
+// The context is cancelled when the processing of the queue is stopped, when the job
+// runs out of time, or when the lock on the job is lost and another worker may pick
+// it up. A non-nil error fails the job, which is then given back to the queue to be
+// retried.
+type HandlerFunction func(context.Context, *queue.Job) (interface{}, error)
+
 // Catapult is the main catapult program
 type Catapult struct {
 	Delegates map[string]DelegateFunction
+	Handlers  map[string]HandlerFunction
 	Control   chan string
-	Result    chan string
+	Signal    chan string
+
+	broker     queue.Broker
+	rClient    *redis.Pool
+	locks      lock.Backend
+	store      store.Store
+	prefix     string
+	logger     logger.Logger
+	metrics    *metrics.Metrics
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	origin     string
 
-	dClient *disque.DisquePool
-	rClient *redis.Pool
-	prefix  string
+	mutex      sync.Mutex
+	processors map[string]*processor
+	retries    map[string]*queue.RetryPolicy
+	rateLimits map[string]*RateLimit
+	timeouts   map[string]time.Duration
+	recurring  map[string]*RecurringJob
+	middleware []Middleware
+	queueChain map[string][]Middleware
+	dispatcher *dispatcher
+	scheduling sync.Once
+	background sync.WaitGroup
+	tasks      map[*task]struct{}
+	shutdown   sync.Mutex
+	closed     chan struct{}
 
-	processing bool
+	listeners     []*listener
+	broadcasting  sync.Mutex
+	broadcast     func()
+	broadcastDone chan struct{}
 }
 
-// DisqueConnectOptions is the parameters for connecting to disque
-type DisqueConnectOptions struct {
-	Address string
+// BrokerConnectOptions is the parameters for connecting to a job broker
+type BrokerConnectOptions interface {
+	// NewBroker creates the broker, given the redis pool of the catapult
+	NewBroker(rClient *redis.Pool) queue.Broker
 }
 
-// RedisConnectOptions is the paramters for connecting to redis
-type RedisConnectOptions struct {
+// DisqueConnectOptions is the parameters for connecting to disque
+type DisqueConnectOptions struct {
 	Address string
-	Auth    string
-	DB      string
 }
 
-// Connect creates a catapult instance
-func Connect(dOptions *DisqueConnectOptions, rOptions *RedisConnectOptions) (catapult *Catapult) {
-	// Connect to disque
+// NewBroker creates a disque broker
+func (o *DisqueConnectOptions) NewBroker(rClient *redis.Pool) queue.Broker {
 	dClient := disque.NewDisquePool(
 		[]string{
-			dOptions.Address,
+			o.Address,
 		},
 		1000,           // cycle
 		5,              // initial capacity
 		20,             // max capacity
 		15*time.Minute, // idle timeout
 	)
+	return queue.NewDisqueBroker(dClient)
+}
+
+// RedisConnectOptions is the paramters for connecting to redis
+type RedisConnectOptions struct {
+	Address string
+	Auth    string
+	DB      string
+}
+
+// RedisBrokerConnectOptions is the parameters for using redis as the broker
+type RedisBrokerConnectOptions struct {
+	Redis             *RedisConnectOptions // redis to connect to, defaults to the catapult's redis
+	VisibilityTimeout time.Duration        // time a fetched job stays in flight before it is requeued
+}
+
+// NewBroker creates a redis broker
+func (o *RedisBrokerConnectOptions) NewBroker(rClient *redis.Pool) queue.Broker {
+	var broker *queue.RedisBroker
+	if o.Redis != nil {
+		broker = queue.NewRedisBroker(newRedisPool(o.Redis), true)
+	} else if rClient != nil {
+		broker = queue.NewRedisBroker(rClient, false)
+	} else {
+		panic(ErrNoRedis)
+	}
+	if o.VisibilityTimeout > 0 {
+		broker.VisibilityTimeout = o.VisibilityTimeout
+	}
+	return broker
+}
+
+// MemoryConnectOptions is the parameters for keeping jobs in process memory
+type MemoryConnectOptions struct {
+	Broker            *queue.MemoryBroker // broker to share between instances, created if nil
+	VisibilityTimeout time.Duration       // time a fetched job stays in flight before it is requeued
+}
+
+// NewBroker creates an in-memory broker
+func (o *MemoryConnectOptions) NewBroker(rClient *redis.Pool) queue.Broker {
+	if o.Broker == nil {
+		o.Broker = queue.NewMemoryBroker()
+	}
+	if o.VisibilityTimeout > 0 {
+		o.Broker.VisibilityTimeout = o.VisibilityTimeout
+	}
+	return o.Broker
+}
+
+// Connect creates a catapult instance
+//
+// If rOptions is nil, locks and bookkeeping are kept in process memory instead of
+// redis, which together with MemoryConnectOptions needs no outside services at all.
+func Connect(bOptions BrokerConnectOptions, rOptions *RedisConnectOptions) (catapult *Catapult) {
 	// Connect to redis
-	rClient := &redis.Pool{
-		MaxIdle:     3,                 // max idle connections
-		IdleTimeout: 240 * time.Second, // idle timeout
-		Dial: func() (redis.Conn, error) {
-			// Construct connection
-			conn, err := redis.Dial("tcp", rOptions.Address)
-			if err != nil {
-				return nil, err
-			}
-			// Authenticate if necessary
-			if rOptions.Auth != "" {
-				if _, err := conn.Do("AUTH", rOptions.Auth); err != nil {
-					conn.Close()
-					return nil, err
-				}
-			}
-			// Select db if necessary
-			if rOptions.DB != "" {
-				if _, err := conn.Do("SELECT", rOptions.DB); err != nil {
-					conn.Close()
-					return nil, err
-				}
-			}
-			return conn, nil
-		},
+	var rClient *redis.Pool
+	var locks lock.Backend
+	var s store.Store
+	if rOptions != nil {
+		rClient = newRedisPool(rOptions)
+		locks = lock.NewRedisBackend(rClient)
+		s = store.NewRedisStore(rClient)
+	} else {
+		locks = lock.NewMemoryBackend()
+		s = store.NewMemoryStore()
 	}
+	// Connect to the broker
+	broker := bOptions.NewBroker(rClient)
+	origin, _ := newJobID("")
 	// Construct catapult
 	catapult = &Catapult{
 		Delegates:  make(map[string]DelegateFunction),
+		Handlers:   make(map[string]HandlerFunction),
 		Control:    make(chan string, 1),
-		Result:     make(chan string, 1),
-		dClient:    dClient,
+		Signal:     make(chan string, 1),
+		broker:     broker,
 		rClient:    rClient,
+		locks:      locks,
+		store:      s,
 		prefix:     "ctpq:",
-		processing: false,
+		logger:     logger.Default(),
+		tracer:     otel.GetTracerProvider().Tracer(TracerName),
+		propagator: defaultPropagator(),
+		origin:     origin,
+		processors: make(map[string]*processor),
+		retries:    make(map[string]*queue.RetryPolicy),
+		rateLimits: make(map[string]*RateLimit),
+		timeouts:   make(map[string]time.Duration),
+		recurring:  make(map[string]*RecurringJob),
+		queueChain: make(map[string][]Middleware),
+		dispatcher: &dispatcher{},
+		tasks:      make(map[*task]struct{}),
+		closed:     make(chan struct{}),
 	}
+	go catapult.listen()
+	catapult.background.Add(1)
+	go catapult.runPromoter()
 	return
 }
 
 // Delegate tasks from a specific queue to a function
 func (c *Catapult) Delegate(queueName string, fn DelegateFunction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.Delegates[queueName] = fn
+	c.Handlers[queueName] = c.AdaptDelegate(fn)
+	return
+}
+
+// Handle tasks from a specific queue with a context aware function
+func (c *Catapult) Handle(queueName string, fn HandlerFunction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.Delegates, queueName)
+	c.Handlers[queueName] = fn
 	return
 }
 
+// AdaptDelegate adapts a delegate function to the handler signature
+//
+// The delegate ignores the context and can only fail the job by panicking.
+func (c *Catapult) AdaptDelegate(fn DelegateFunction) HandlerFunction {
+	return func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		return fn(job, job.QueueName, c), nil
+	}
+}
+
 // Add is a public interface for queue.AddJob
-func (c *Catapult) Add(queueName string, body string, ETA time.Time, options *map[string]string) (job *queue.Job, err error) {
-	job, err = queue.AddJob(c.dClient, queueName, body, ETA, options)
+//
+// The options may be nil. With a dedup key, the job already added with the same
+// key is returned instead of adding a duplicate. Jobs due beyond the staging
+// horizon are staged until they come within range.
+func (c *Catapult) Add(queueName string, body string, ETA time.Time, options *queue.AddOptions) (job *queue.Job, err error) {
+	job, err = c.AddContext(context.Background(), queueName, body, ETA, options)
+	return
+}
+
+// AddContext adds a job like Add, carrying the trace context of ctx on the job
+//
+// The job is added in a span of the trace, and processed in a child span of it.
+func (c *Catapult) AddContext(ctx context.Context, queueName string, body string, ETA time.Time, options *queue.AddOptions) (job *queue.Job, err error) {
+	job, err = queue.NewJobWithOptions(queueName, body, ETA, options)
+	if err != nil {
+		return
+	}
+	_, span := c.startPublish(ctx, job)
+	defer func() {
+		if job != nil {
+			span.SetAttributes(attribute.String("catapult.job.id", job.ID))
+		}
+		failSpan(span, err)
+		span.End()
+	}()
+	if options != nil && options.DedupKey != "" {
+		job, err = c.addOnce(job, options)
+		return
+	}
+	err = c.enqueue(job)
+	if err != nil {
+		job = nil
+		return
+	}
+	// Leave the record alone if a worker already picked the job up
+	c.transition(job, queue.StateScheduled, stateNone)
+	c.getMetrics().JobEnqueued(queueName)
+	c.emit(EventAdded, job, nil)
 	return
 }
 
 // Get is a public interface for queue.GetJob
+//
+// The state of the job and its transitions are filled in as tracked; jobs that are
+// done are no longer got, see Inspect.
 func (c *Catapult) Get(id string) (job *queue.Job, err error) {
-	job, err = queue.GetJob(c.dClient, id)
+	job, err = c.getStagedJob(id)
+	if err != nil {
+		return
+	}
+	if job == nil {
+		var messageID string
+		messageID, err = c.resolve(id)
+		if err != nil {
+			return
+		}
+		job, err = queue.GetJob(c.broker, messageID)
+		if err != nil || job == nil {
+			return
+		}
+	}
+	err = c.withState(job)
 	return
 }
 
 // Remove is the public interface for queue.RemoveJob
 func (c *Catapult) Remove(id string) (err error) {
-	err = queue.RemoveJob(c.dClient, id)
+	job, err := c.Get(id)
+	if err != nil {
+		return
+	}
+	// Remove the job from the stage first, so that it is not promoted meanwhile
+	err = c.unstage(id)
+	if err != nil {
+		return
+	}
+	messageID, err := c.resolve(id)
+	if err != nil {
+		return
+	}
+	err = queue.RemoveJob(c.broker, messageID)
+	if err != nil {
+		return
+	}
+	err = c.store.Delete(c.getKeyForAlias(id))
+	if err != nil {
+		return
+	}
+	err = c.forget(id)
+	if err != nil {
+		return
+	}
+	if job != nil {
+		c.release(job)
+	}
 	return
 }
 
 // Process kicks off the processing of jobs
+//
+// Up to concurrency jobs are processed at the same time, each by its own worker.
+// Process blocks until the processing of the queue is stopped.
 func (c *Catapult) Process(queueName string, concurrency int) {
-	// Check if there is a delegate for this queue
-	if _, exists := c.Delegates[queueName]; !exists {
+	c.ProcessQueue(queueName, &QueueOptions{
+		Concurrency: concurrency,
+	})
+}
+
+// ProcessQueue kicks off the processing of jobs from a queue with the options
+//
+// Any number of queues can be processed at the same time, each by its own call.
+// ProcessQueue blocks until the processing of the queue is stopped, and returns
+// right away if the queue has no handler or is already being processed.
+func (c *Catapult) ProcessQueue(queueName string, options *QueueOptions) {
+	c.mutex.Lock()
+	// Check if there is a handler for this queue
+	handler, exists := c.Handlers[queueName]
+	if delegate, delegated := c.Delegates[queueName]; !exists && delegated {
+		handler, exists = c.AdaptDelegate(delegate), true
+	}
+	if !exists {
 		// If not, do thing
+		c.mutex.Unlock()
+		return
+	}
+	// Register the processor, unless shut down
+	if _, exists := c.processors[queueName]; exists || c.isClosed() {
+		c.mutex.Unlock()
 		return
 	}
-	delegate := c.Delegates[queueName]
-	// Mark as processing
-	c.processing = true
-	var job *queue.Job
+	p := newProcessor(queueName, *options, c.chain(queueName, handler))
+	c.processors[queueName] = p
+	c.mutex.Unlock()
+	// Run until stopped
+	p.run(c)
+	c.mutex.Lock()
+	delete(c.processors, queueName)
+	c.mutex.Unlock()
+}
+
+// Stop stops the processing of a queue, waiting for the running handlers to return
+//
+// Fetching stops right away, and the running handlers have their context cancelled;
+// the jobs they give up are nacked, so that they are picked up again. To let the
+// running jobs finish instead, use Shutdown.
+func (c *Catapult) Stop(queueName string) {
+	if p := c.getProcessor(queueName); p != nil {
+		p.stop()
+	}
+}
+
+// Pause stops fetching jobs from a queue until it is resumed
+func (c *Catapult) Pause(queueName string) {
+	if p := c.getProcessor(queueName); p != nil {
+		p.pause()
+	}
+}
+
+// Resume resumes fetching jobs from a paused queue
+func (c *Catapult) Resume(queueName string) {
+	if p := c.getProcessor(queueName); p != nil {
+		p.resume()
+	}
+}
+
+// SetLogger sets the logger of the events of the catapult and its job locks
+//
+// By default, the events are logged to slog.Default(), with the routine ones at
+// the debug level. A nil logger drops all events.
+func (c *Catapult) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.Nop
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.logger = l
+}
+
+// SetMetrics sets the Prometheus collectors the catapult and its locks report to
+//
+// The number of jobs per queue and state is counted on every collection, for the
+// queues with a handler. A nil metrics stops the reporting.
+func (c *Catapult) SetMetrics(m *metrics.Metrics) {
+	if m != nil {
+		m.SetDepthCounter(c.countDepth)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metrics = m
+}
+
+// SetWorkers limits the number of jobs processed at the same time across all queues
+//
+// While the queues compete for the workers, they are shared according to the
+// priority and weight of each queue. A limit of 0 removes the limit.
+func (c *Catapult) SetWorkers(n int) {
+	c.dispatcher.setLimit(n)
+}
+
+// Close shuts down the catapult, cancelling the running jobs and waiting for them to return
+func (c *Catapult) Close() {
+	c.stopAll()
+	_ = c.Shutdown(context.Background())
+}
+
+// Private functions
+
+func newRedisPool(rOptions *RedisConnectOptions) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,                 // max idle connections
+		IdleTimeout: 240 * time.Second, // idle timeout
+		Dial: func() (redis.Conn, error) {
+			// Construct connection
+			conn, err := redis.Dial("tcp", rOptions.Address)
+			if err != nil {
+				return nil, err
+			}
+			// Authenticate if necessary
+			if rOptions.Auth != "" {
+				if _, err := conn.Do("AUTH", rOptions.Auth); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			// Select db if necessary
+			if rOptions.DB != "" {
+				if _, err := conn.Do("SELECT", rOptions.DB); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		},
+	}
+}
+
+func (c *Catapult) getProcessor(queueName string) *processor {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.processors[queueName]
+}
+
+func (c *Catapult) stopAll() {
+	for _, p := range c.listProcessors() {
+		p.stop()
+	}
+}
+
+func (c *Catapult) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// listen serves the commands sent on the control channel
+func (c *Catapult) listen() {
 	for {
 		select {
 		case command := <-c.Control:
-			// Listen for controls
 			if command == CatapultCMDStopProcessing {
-				c.Result <- CatapultSignalStopProcSuccess
-				c.processing = false
-				return
-			}
-		default:
-			// Fetch jobs from the queue
-			jobs, err := queue.FetchJobs(c.dClient, queueName, concurrency)
-			if err != nil {
-				continue
-			}
-			// Process jobs
-			for _, job = range jobs {
-				c.process(job, queueName, delegate)
-				fmt.Println("Done processing")
+				c.stopAll()
+				c.Signal <- CatapultSignalStopProcSuccess
 			}
+		case <-c.closed:
+			return
 		}
 	}
 }
 
-// Close shuts down the catapult
-func (c *Catapult) Close() {
-	if c.processing {
-		c.Control <- CatapultCMDStopProcessing
-		_ = <-c.Result
-	}
-	c.dClient.Close()
-	c.rClient.Close()
+func (c *Catapult) log() logger.Logger {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.logger
 }
 
-// Private functions
+func (c *Catapult) getMetrics() *metrics.Metrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.metrics
+}
+
+// newLock creates a lock on a key, reporting to the logger and metrics of the catapult
+func (c *Catapult) newLock(key string, ar bool) *lock.Lock {
+	l := lock.NewLockWithBackend(c.locks, key, ar)
+	l.Logger = c.log()
+	l.Metrics = c.getMetrics()
+	return l
+}
+
+// jobFields gets the fields identifying a job in the events, followed by the fields
+func jobFields(job *queue.Job, fields ...logger.Field) []logger.Field {
+	return append([]logger.Field{
+		logger.F("queue", job.QueueName),
+		logger.F("job", job.ID),
+		logger.F("attempt", job.Attempt),
+	}, fields...)
+}
 
 func (c *Catapult) getKeyForJob(job *queue.Job) string {
 	return c.prefix + job.ID
 }
 
-func (c *Catapult) process(job *queue.Job, queueName string, fn DelegateFunction) {
-	fmt.Println("Start processing: ", job.ID)
+func (c *Catapult) process(parent context.Context, job *queue.Job, queueName string, fn HandlerFunction) {
+	var t *task
+	var started time.Time
+	// Continue the trace the job was added in
+	traced, span := c.startProcess(parent, job)
+	defer span.End()
 	// Catch any panics
 	defer func() {
 		if r := recover(); r != nil {
 			// Log out the error
-			fmt.Println(r)
-			// Nack the job
-			_ = queue.NackJob(c.dClient, job.ID)
+			c.log().Log(logger.LevelError, "job panicked", jobFields(job, logger.F("panic", r))...)
+			if !started.IsZero() {
+				c.getMetrics().JobFinished(queueName, metrics.OutcomeFailed, time.Since(started))
+			}
+			cause := fmt.Errorf("%v", r)
+			failSpan(span, cause)
+			if !started.IsZero() {
+				c.emit(EventFailed, job, cause)
+			}
+			// Retry the job per its retry policy, unless given up on shutdown
+			if t == nil || t.settle() {
+				c.fail(traced, job, cause)
+			}
 		}
 	}()
 	// Acquire a lock on the job
 	key := c.getKeyForJob(job)
-	l := lock.NewLockOnKey(c.rClient, key, true)
+	l := c.newLock(key, true)
+	l.Duration = JobLockDuration
+	_, lockSpan := c.getTracer().Start(traced, "lock")
 	result, err := l.Get()
+	lockSpan.SetAttributes(attribute.Bool("catapult.lock.acquired", result))
+	failSpan(lockSpan, err)
+	lockSpan.End()
 	// If lock cannot be acquired, return
 	if err != nil {
 		return
@@ -196,13 +584,102 @@ func (c *Catapult) process(job *queue.Job, queueName string, fn DelegateFunction
 		return
 	}
 	// Make sure to release the lock
-	defer l.Release()
+	t = c.track(traced, job, l)
+	defer c.untrack(t)
+	// Cancel the job if the lock is lost, as another worker may pick it up
+	ctx, cancel := context.WithCancel(traced)
+	defer cancel()
+	go func() {
+		select {
+		case <-l.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// Drop the message if the job was rescheduled onto another one
+	if c.moved(job) {
+		_ = c.ack(ctx, job.MessageID)
+		return
+	}
+	// Wait out the part of the ETA the broker rounded off
+	if wait := job.ETA.Sub(time.Now()); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			_ = c.nack(traced, job.MessageID)
+			return
+		}
+	}
+	// Hold back or delay the job if the queue is over its rate limit
+	if !c.admit(ctx, job) {
+		return
+	}
 	// Start processing
-	fn(job, queueName, c)
-	// If success, ack the job
-	err = queue.AckJob(c.dClient, job.ID)
+	c.transition(job, queue.StateActive)
+	c.log().Log(logger.LevelDebug, "job started", jobFields(job)...)
+	started = time.Now()
+	m := c.getMetrics()
+	m.JobStarted(queueName, started.Sub(job.ETA))
+	c.emit(EventStarted, job, nil)
+	value, err := c.run(ctx, job, fn)
+	elapsed := time.Since(started)
+	duration := logger.F("duration", elapsed)
+	// Leave the job alone if it was given up on shutdown
+	if !t.settle() {
+		m.JobFinished(queueName, metrics.OutcomeInterrupted, elapsed)
+		return
+	}
+	// If the lock was lost, nack the job so that it is redelivered right away
+	select {
+	case <-l.Lost():
+		m.JobFinished(queueName, metrics.OutcomeInterrupted, elapsed)
+		c.log().Log(logger.LevelWarn, "job lock lost", jobFields(job, duration)...)
+		c.emit(EventLockLost, job, nil)
+		c.transition(job, queue.StateScheduled)
+		_ = c.nack(traced, job.MessageID)
+		return
+	default:
+	}
+	if err != nil {
+		failSpan(span, err)
+		// If stopped, nack the job so that it is redelivered right away
+		if parent.Err() != nil {
+			m.JobFinished(queueName, metrics.OutcomeInterrupted, elapsed)
+			c.log().Log(logger.LevelInfo, "job interrupted", jobFields(job, duration, logger.F("error", err))...)
+			c.transition(job, queue.StateScheduled)
+			_ = c.nack(traced, job.MessageID)
+			return
+		}
+		// If failed, retry the job per its retry policy
+		m.JobFinished(queueName, metrics.OutcomeFailed, elapsed)
+		c.log().Log(logger.LevelWarn, "job failed", jobFields(job, duration, logger.F("error", err))...)
+		c.emit(EventFailed, job, err)
+		c.fail(traced, job, err)
+		return
+	}
+	// If success, keep the result and ack the job
+	c.transition(job, queue.StateCompleted)
+	c.saveResult(job, value, nil)
+	m.JobFinished(queueName, metrics.OutcomeCompleted, elapsed)
+	c.log().Log(logger.LevelDebug, "job completed", jobFields(job, duration)...)
+	c.emit(EventSucceeded, job, nil)
+	err = c.ack(traced, job.MessageID)
 	if err != nil {
-		fmt.Println(err)
+		c.log().Log(logger.LevelError, "job ack failed", jobFields(job, logger.F("error", err))...)
 	}
+	c.unalias(job)
+	c.release(job)
 	return
 }
+
+// newJobID creates a job id, for jobs given an id before they reach the broker
+func newJobID(prefix string) (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(raw), nil
+}
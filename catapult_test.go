@@ -1,25 +1,38 @@
 package catapult
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
+	"catapult/lock"
+	"catapult/logger"
+	"catapult/metrics"
 	"catapult/queue"
+	"catapult/schedule"
 )
 
 var testQueue = "tq"
 
+func init() {
+	// Keep the wait for stopping the processing short
+	queue.FetchTimeout = "1s"
+}
+
 func getInstance() *Catapult {
-	dOptions := &DisqueConnectOptions{
-		Address: "127.0.0.1:7711",
-	}
-	rOptions := &RedisConnectOptions{
-		Address: "127.0.0.1:6379",
-		DB:      "7",
-	}
-	catapult := Connect(dOptions, rOptions)
+	mOptions := &MemoryConnectOptions{}
+	catapult := Connect(mOptions, nil)
 	return catapult
 }
 
@@ -129,3 +142,1376 @@ func TestProcessThroughPut(t *testing.T) {
 		assert.Empty(_job)
 	}
 }
+
+func TestProcessConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqprocconc"
+	// Set up a slow delegate, tracking how many run at the same time
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	delegate := func(job *queue.Job, qName string, c *Catapult) interface{} {
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+		time.Sleep(500 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	}
+	catapult.Delegate(qName, delegate)
+	// Kick off the processing
+	go catapult.Process(qName, 4)
+	// Add some jobs
+	jobs := make([]*queue.Job, 8)
+	for i := 0; i < 8; i++ {
+		job, err := catapult.Add(qName, "process job", time.Now(), nil)
+		assert.Empty(err)
+		jobs[i] = job
+	}
+	// Two rounds of four parallel jobs
+	time.Sleep(1500 * time.Millisecond)
+	for _, job := range jobs {
+		_job, err := catapult.Get(job.ID)
+		assert.Empty(err)
+		assert.Empty(_job)
+	}
+	mutex.Lock()
+	assert.Equal(4, peak)
+	mutex.Unlock()
+}
+
+func TestProcessMultipleQueues(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qNames := []string{"tqmulti1", "tqmulti2"}
+	// Set up delegates counting the processed jobs
+	var mutex sync.Mutex
+	processed := make(map[string]int)
+	delegate := func(job *queue.Job, qName string, c *Catapult) interface{} {
+		mutex.Lock()
+		processed[qName]++
+		mutex.Unlock()
+		return nil
+	}
+	for _, qName := range qNames {
+		catapult.Delegate(qName, delegate)
+		go catapult.ProcessQueue(qName, &QueueOptions{Concurrency: 2})
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Pause the first queue
+	catapult.Pause(qNames[0])
+	for _, qName := range qNames {
+		_, err := catapult.Add(qName, "process job", time.Now(), nil)
+		assert.Empty(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	mutex.Lock()
+	assert.Equal(0, processed[qNames[0]])
+	assert.Equal(1, processed[qNames[1]])
+	mutex.Unlock()
+	// Resume the first queue and stop the second
+	catapult.Resume(qNames[0])
+	catapult.Stop(qNames[1])
+	for _, qName := range qNames {
+		_, err := catapult.Add(qName, "process job", time.Now(), nil)
+		assert.Empty(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	mutex.Lock()
+	assert.Equal(2, processed[qNames[0]])
+	assert.Equal(1, processed[qNames[1]])
+	mutex.Unlock()
+}
+
+func TestProcessQueuePriority(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	catapult.SetWorkers(1)
+	high, low := "tqhigh", "tqlow"
+	// Set up delegates recording the order of the jobs
+	var mutex sync.Mutex
+	order := make([]string, 0)
+	delegate := func(job *queue.Job, qName string, c *Catapult) interface{} {
+		mutex.Lock()
+		order = append(order, qName)
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	catapult.Delegate(high, delegate)
+	catapult.Delegate(low, delegate)
+	// Add the jobs before processing
+	for i := 0; i < 3; i++ {
+		_, err := catapult.Add(low, "low job", time.Now(), nil)
+		assert.Empty(err)
+		_, err = catapult.Add(high, "high job", time.Now(), nil)
+		assert.Empty(err)
+	}
+	go catapult.ProcessQueue(high, &QueueOptions{Concurrency: 2, Priority: 1})
+	time.Sleep(10 * time.Millisecond)
+	go catapult.ProcessQueue(low, &QueueOptions{Concurrency: 2})
+	time.Sleep(time.Second)
+	// The shared worker goes to the high priority queue first
+	mutex.Lock()
+	assert.Equal([]string{high, high, high, low, low, low}, order)
+	mutex.Unlock()
+}
+
+func TestHandleJobs(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqhandle"
+	// Set up a handler failing the first attempt
+	var mutex sync.Mutex
+	attempts := 0
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("first attempt fails")
+		}
+		return job.Body, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "handle job", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(500 * time.Millisecond)
+	// The failed job is retried
+	mutex.Lock()
+	assert.Equal(2, attempts)
+	mutex.Unlock()
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestHandlerCancelledOnStop(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqhandlestop"
+	// Set up a handler running until cancelled
+	started := make(chan struct{})
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "handle job", time.Now(), nil)
+	assert.Empty(err)
+	<-started
+	catapult.Stop(qName)
+	// The cancelled job is given back to the queue
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
+
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	qName := "tqshutdown"
+	// Set up a handler finishing when told to, ignoring the context
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		close(started)
+		<-finish
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 2)
+	done, err := catapult.Add(qName, "done job", time.Now(), nil)
+	assert.Empty(err)
+	<-started
+	// Running jobs are waited for until the deadline
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(finish)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	err = catapult.Shutdown(ctx)
+	cancel()
+	assert.Empty(err)
+	_job, err := catapult.Get(done.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// No jobs are fetched once shut down
+	catapult.Process(qName, 1)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	qName := "tqshutdowndeadline"
+	// Set up a handler ignoring the context
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		close(started)
+		<-finish
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "stuck job", time.Now(), nil)
+	assert.Empty(err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err = catapult.Shutdown(ctx)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+	// The job is given back to the queue with its lock released
+	l := lock.NewLockWithBackend(catapult.locks, catapult.getKeyForJob(job), false)
+	l.MaxAttempts = 1
+	result, err := l.Get()
+	assert.Empty(err)
+	assert.True(result)
+	l.Release()
+	// and is not acked once the handler returns
+	close(finish)
+	time.Sleep(100 * time.Millisecond)
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+}
+
+// lossyBackend is a lock backend failing to extend the locks once told to
+type lossyBackend struct {
+	lock.Backend
+	mutex sync.Mutex
+	lossy bool
+}
+
+func (b *lossyBackend) Extend(key string, value string, duration time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lossy {
+		return false, nil
+	}
+	return b.Backend.Extend(key, value, duration)
+}
+
+func TestJobLockLost(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	backend := &lossyBackend{Backend: catapult.locks}
+	catapult.locks = backend
+	duration := JobLockDuration
+	JobLockDuration = 200 * time.Millisecond
+	defer func() {
+		JobLockDuration = duration
+	}()
+	qName := "tqlocklost"
+	// Set up a handler running until cancelled, once
+	cancelled := make(chan struct{})
+	var once sync.Once
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		first := false
+		once.Do(func() {
+			first = true
+		})
+		if !first {
+			return nil, nil
+		}
+		<-ctx.Done()
+		close(cancelled)
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "lost job", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(50 * time.Millisecond)
+	// Losing the lock cancels the job instead of crashing the worker
+	backend.mutex.Lock()
+	backend.lossy = true
+	backend.mutex.Unlock()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail("job is not cancelled")
+	}
+	backend.mutex.Lock()
+	backend.lossy = false
+	backend.mutex.Unlock()
+	// The job is nacked rather than acked, and processed again once the lost lock expires
+	var _job *queue.Job
+	for i := 0; i < 20; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_job, err = catapult.Get(job.ID)
+		assert.Empty(err)
+		if _job == nil {
+			break
+		}
+	}
+	assert.Empty(_job)
+}
+
+func TestJobResults(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqresults"
+	// Set up a handler failing the jobs with a failing body
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		if job.Body == "fail" {
+			return nil, errors.New("failed")
+		}
+		return map[string]string{"body": job.Body}, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{MaxAttempts: 1})
+	job, err := catapult.Add(qName, "done", time.Now().Add(100*time.Millisecond), nil)
+	assert.Empty(err)
+	failed, err := catapult.Add(qName, "fail", time.Now(), nil)
+	assert.Empty(err)
+	result, err := catapult.Result(job.ID)
+	assert.Empty(err)
+	assert.Empty(result)
+	go catapult.Process(qName, 1)
+	// Waiting returns the value of the job once it is done
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	result, err = catapult.Wait(ctx, job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(result)
+	value := map[string]string{}
+	assert.Empty(result.Decode(&value))
+	assert.Equal("done", value["body"])
+	// or its error once it is dead
+	result, err = catapult.Wait(ctx, failed.ID)
+	assert.Empty(err)
+	assert.NotEmpty(result)
+	assert.Equal("failed", result.Error)
+	// Waiting gives up with the context
+	short, stop := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer stop()
+	_, err = catapult.Wait(short, "missing")
+	assert.Equal(context.DeadlineExceeded, err)
+}
+
+func TestJobStates(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqstates"
+	// Set up a handler running until told to finish
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		close(started)
+		<-finish
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	job, err := catapult.Add(qName, "state job", time.Now().Add(100*time.Millisecond), nil)
+	assert.Empty(err)
+	assert.Equal(queue.StateScheduled, job.State)
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.Equal(queue.StateScheduled, _job.State)
+	// The job is queued once due
+	time.Sleep(100 * time.Millisecond)
+	_job, err = catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.Equal(queue.StateQueued, _job.State)
+	go catapult.Process(qName, 1)
+	<-started
+	_job, err = catapult.Inspect(job.ID)
+	assert.Empty(err)
+	assert.Equal(queue.StateActive, _job.State)
+	// and completed once processed, with a timestamp for each transition
+	close(finish)
+	time.Sleep(100 * time.Millisecond)
+	_job, err = catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	_job, err = catapult.Inspect(job.ID)
+	assert.Empty(err)
+	assert.Equal(queue.StateCompleted, _job.State)
+	states := make([]queue.State, 0)
+	for i, transition := range _job.Transitions {
+		states = append(states, transition.State)
+		if i > 0 {
+			assert.False(transition.At.Before(_job.Transitions[i-1].At))
+		}
+	}
+	assert.Equal([]queue.State{queue.StateScheduled, queue.StateQueued, queue.StateActive, queue.StateCompleted}, states)
+}
+
+func TestJobRecords(t *testing.T) {
+	assert := assert.New(t)
+	margin := dropMargin
+	dropMargin = 0
+	defer func() {
+		dropMargin = margin
+	}()
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqrecords"
+	job, err := catapult.Add(qName, "record job", time.Now(), nil)
+	assert.Empty(err)
+	// A late record of the job being added leaves a worker's record alone
+	active := *job
+	catapult.transition(&active, queue.StateActive)
+	late := *job
+	catapult.transition(&late, queue.StateScheduled, stateNone)
+	_job, err := catapult.Inspect(job.ID)
+	assert.Empty(err)
+	assert.Equal(queue.StateActive, _job.State)
+	jobs, err := catapult.Jobs(qName, queue.StateQueued, time.Time{}, time.Time{}, 0, -1)
+	assert.Empty(err)
+	assert.Len(jobs, 0)
+	jobs, err = catapult.Jobs(qName, queue.StateActive, time.Time{}, time.Time{}, 0, -1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	// The records of jobs the broker may drop go with them
+	ttl := &queue.AddOptions{PushOptions: queue.PushOptions{TTL: 50 * time.Millisecond}}
+	job, err = catapult.Add(qName, "ttl job", time.Now(), ttl)
+	assert.Empty(err)
+	_job, err = catapult.Inspect(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	time.Sleep(100 * time.Millisecond)
+	_job, err = catapult.Inspect(job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestInspectJobs(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqinspect"
+	// Add jobs due now and later, tagged by customer
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		tag := "customer:" + strconv.Itoa(i%2)
+		ETA := now.Add(time.Duration(i) * time.Hour)
+		_, err := catapult.Add(qName, "job"+strconv.Itoa(i), ETA, &queue.AddOptions{Tags: []string{tag}})
+		assert.Empty(err)
+	}
+	counts, err := catapult.CountJobs(qName)
+	assert.Empty(err)
+	assert.Equal(1, counts[queue.StateQueued])
+	assert.Equal(4, counts[queue.StateScheduled])
+	assert.Equal(0, counts[queue.StateCompleted])
+	// List the scheduled jobs in a range, a page at a time
+	jobs, err := catapult.Jobs(qName, queue.StateScheduled, now.Add(90*time.Minute), time.Time{}, 0, 2)
+	assert.Empty(err)
+	assert.Len(jobs, 2)
+	assert.Equal("job2", jobs[0].Body)
+	assert.Equal("job3", jobs[1].Body)
+	jobs, err = catapult.Jobs(qName, queue.StateScheduled, now.Add(90*time.Minute), time.Time{}, 2, 2)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal("job4", jobs[0].Body)
+	jobs, err = catapult.Jobs(qName, queue.StateQueued, time.Time{}, time.Time{}, 0, -1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal("job0", jobs[0].Body)
+	// Find the jobs of a customer
+	jobs, err = catapult.JobsByTag("customer:1", 0, -1)
+	assert.Empty(err)
+	assert.Len(jobs, 2)
+	assert.ElementsMatch([]string{"job1", "job3"}, []string{jobs[0].Body, jobs[1].Body})
+	// Removed jobs are no longer found
+	assert.Empty(catapult.Remove(jobs[0].ID))
+	jobs, err = catapult.JobsByTag("customer:1", 0, -1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	counts, err = catapult.CountJobs(qName)
+	assert.Empty(err)
+	assert.Equal(3, counts[queue.StateScheduled])
+}
+
+// recordingLogger is a logger keeping the events
+type recordingLogger struct {
+	mutex  sync.Mutex
+	events []recordedEvent
+}
+
+type recordedEvent struct {
+	level  logger.Level
+	msg    string
+	fields map[string]interface{}
+}
+
+func (l *recordingLogger) Log(level logger.Level, msg string, fields ...logger.Field) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	event := recordedEvent{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, field := range fields {
+		event.fields[field.Key] = field.Value
+	}
+	l.events = append(l.events, event)
+}
+
+func (l *recordingLogger) find(msg string) *recordedEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, event := range l.events {
+		if event.msg == msg {
+			return &event
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	l := &recordingLogger{}
+	catapult.SetLogger(l)
+	qName := "tqlogger"
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		if job.Body == "fail" {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{MaxAttempts: 1})
+	job, err := catapult.Add(qName, "done", time.Now(), nil)
+	assert.Empty(err)
+	_, err = catapult.Add(qName, "fail", time.Now(), nil)
+	assert.Empty(err)
+	go catapult.Process(qName, 1)
+	time.Sleep(200 * time.Millisecond)
+	// The events carry the queue, job, attempt and duration
+	started := l.find("job started")
+	assert.NotEmpty(started)
+	assert.Equal(logger.LevelDebug, started.level)
+	completed := l.find("job completed")
+	assert.NotEmpty(completed)
+	assert.Equal(qName, completed.fields["queue"])
+	assert.Equal(job.ID, completed.fields["job"])
+	assert.Equal(1, completed.fields["attempt"])
+	assert.NotEmpty(completed.fields["duration"])
+	failed := l.find("job failed")
+	assert.NotEmpty(failed)
+	assert.Equal(logger.LevelWarn, failed.level)
+	assert.Equal("failed", failed.fields["error"].(error).Error())
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	m := metrics.New("")
+	catapult.SetMetrics(m)
+	qName := "tqmetrics"
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		if job.Body == "fail" {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{MaxAttempts: 2})
+	_, err := catapult.Add(qName, "done", time.Now(), nil)
+	assert.Empty(err)
+	_, err = catapult.Add(qName, "fail", time.Now(), nil)
+	assert.Empty(err)
+	_, err = catapult.Add(qName, "later", time.Now().Add(time.Hour), nil)
+	assert.Empty(err)
+	assert.Equal(float64(3), testutil.ToFloat64(m.Enqueued.WithLabelValues(qName)))
+	go catapult.Process(qName, 1)
+	time.Sleep(300 * time.Millisecond)
+	// The failed job is retried once, then dead
+	assert.Equal(float64(1), testutil.ToFloat64(m.Processed.WithLabelValues(qName, metrics.OutcomeCompleted)))
+	assert.Equal(float64(2), testutil.ToFloat64(m.Processed.WithLabelValues(qName, metrics.OutcomeFailed)))
+	assert.Equal(float64(1), testutil.ToFloat64(m.Retried.WithLabelValues(qName)))
+	assert.Equal(float64(1), testutil.ToFloat64(m.Dead.WithLabelValues(qName)))
+	assert.Equal(float64(0), testutil.ToFloat64(m.InFlight.WithLabelValues(qName)))
+	assert.Equal(1, testutil.CollectAndCount(m.Duration))
+	assert.Equal(1, testutil.CollectAndCount(m.Lag))
+	assert.True(testutil.ToFloat64(m.LockAttempts) >= 3)
+	// The depth of the queues is counted when scraped
+	expected := `
+# HELP catapult_queue_jobs Number of jobs per queue and state.
+# TYPE catapult_queue_jobs gauge
+catapult_queue_jobs{queue="tqmetrics",state="active"} 0
+catapult_queue_jobs{queue="tqmetrics",state="completed"} 1
+catapult_queue_jobs{queue="tqmetrics",state="dead"} 1
+catapult_queue_jobs{queue="tqmetrics",state="failed"} 0
+catapult_queue_jobs{queue="tqmetrics",state="queued"} 0
+catapult_queue_jobs{queue="tqmetrics",state="scheduled"} 1
+`
+	assert.Empty(testutil.CollectAndCompare(m, strings.NewReader(expected), "catapult_queue_jobs"))
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	catapult.SetTracerProvider(provider)
+	qName := "tqtracing"
+	handled := make(chan trace.SpanContext, 1)
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		handled <- trace.SpanContextFromContext(ctx)
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	// Add the job within the trace of a request
+	ctx, request := provider.Tracer("test").Start(context.Background(), "request")
+	job, err := catapult.AddContext(ctx, qName, "traced job", time.Now(), nil)
+	request.End()
+	assert.Empty(err)
+	assert.NotEmpty(job.Trace["traceparent"])
+	go catapult.Process(qName, 1)
+	var handlerSpan trace.SpanContext
+	select {
+	case handlerSpan = <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("job not processed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	// The processing continues the trace of the request
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	publish, process := spans[qName+" publish"], spans[qName+" process"]
+	assert.NotEmpty(publish)
+	assert.NotEmpty(process)
+	assert.Equal(request.SpanContext().SpanID(), publish.Parent().SpanID())
+	assert.Equal(publish.SpanContext().SpanID(), process.Parent().SpanID())
+	assert.Equal(request.SpanContext().TraceID(), process.SpanContext().TraceID())
+	assert.Equal(process.SpanContext().SpanID(), handlerSpan.SpanID())
+	// The lock and ack are children of the processing
+	assert.Equal(process.SpanContext().SpanID(), spans["lock"].Parent().SpanID())
+	assert.Equal(process.SpanContext().SpanID(), spans["ack"].Parent().SpanID())
+}
+
+// recordingListener records the types of the events it is called with
+type recordingListener struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (l *recordingListener) listen(event Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *recordingListener) types(body string) []EventType {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	types := make([]EventType, 0)
+	for _, event := range l.events {
+		if event.Job.Body == body {
+			types = append(types, event.Type)
+		}
+	}
+	return types
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	all := &recordingListener{}
+	catapult.Listen(all.listen)
+	failures := &recordingListener{}
+	cancel := catapult.Listen(failures.listen, EventFailed, EventDead)
+	catapult.SetLogger(logger.Nop)
+	catapult.Listen(func(event Event) {
+		panic("listener panicked")
+	})
+	qName := "tqevents"
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		if strings.HasPrefix(job.Body, "fail") {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{MaxAttempts: 2})
+	_, err := catapult.Add(qName, "done", time.Now(), nil)
+	assert.Empty(err)
+	_, err = catapult.Add(qName, "fail", time.Now(), nil)
+	assert.Empty(err)
+	go catapult.Process(qName, 1)
+	time.Sleep(300 * time.Millisecond)
+	// The events of each job come in order, undisturbed by the panicking listener
+	assert.Equal([]EventType{EventAdded, EventStarted, EventSucceeded}, all.types("done"))
+	assert.Equal([]EventType{
+		EventAdded, EventStarted, EventFailed, EventRetried, EventStarted, EventFailed, EventDead,
+	}, all.types("fail"))
+	assert.Equal([]EventType{EventFailed, EventFailed, EventDead}, failures.types("fail"))
+	failures.mutex.Lock()
+	assert.Equal("failed", failures.events[2].Error)
+	assert.Equal(2, failures.events[2].Job.Attempt)
+	assert.False(failures.events[2].Remote)
+	failures.mutex.Unlock()
+	// Unregistered listeners are no longer called
+	cancel()
+	_, err = catapult.Add(qName, "fail again", time.Now(), &queue.AddOptions{Retry: &queue.RetryPolicy{MaxAttempts: 1}})
+	assert.Empty(err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(failures.types("fail again"))
+	assert.Equal([]EventType{EventAdded, EventStarted, EventFailed, EventDead}, all.types("fail again"))
+}
+
+func TestBroadcastEvents(t *testing.T) {
+	assert := assert.New(t)
+	producer := getInstance()
+	defer producer.Close()
+	consumer := getInstance()
+	defer consumer.Close()
+	// Share the store, as if sharing redis
+	consumer.store = producer.store
+	local := &recordingListener{}
+	producer.Listen(local.listen)
+	remote := &recordingListener{}
+	consumer.Listen(remote.listen)
+	assert.Empty(producer.BroadcastEvents(true))
+	assert.Empty(consumer.BroadcastEvents(true))
+	job, err := producer.Add("tqbroadcast", "broadcast", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(50 * time.Millisecond)
+	// The event is delivered to the other catapult, and only once to its own
+	assert.Equal([]EventType{EventAdded}, local.types("broadcast"))
+	assert.Equal([]EventType{EventAdded}, remote.types("broadcast"))
+	remote.mutex.Lock()
+	assert.True(remote.events[0].Remote)
+	assert.Equal(job.ID, remote.events[0].Job.ID)
+	assert.Equal(producer.origin, remote.events[0].Origin)
+	remote.mutex.Unlock()
+	// Events are no longer received once the broadcast is off
+	assert.Empty(consumer.BroadcastEvents(false))
+	_, err = producer.Add("tqbroadcast", "unheard", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(remote.types("unheard"))
+}
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	// Record the order the middlewares run in
+	var mutex sync.Mutex
+	calls := make([]string, 0)
+	record := func(name string) Middleware {
+		return func(next HandlerFunction) HandlerFunction {
+			return func(ctx context.Context, job *queue.Job) (interface{}, error) {
+				mutex.Lock()
+				calls = append(calls, name+":"+job.QueueName)
+				mutex.Unlock()
+				return next(ctx, job)
+			}
+		}
+	}
+	l := &recordingLogger{}
+	catapult.Use(record("first"), record("second"))
+	catapult.Use(Logging(l))
+	catapult.UseFor("tqmiddleware", record("queue"), Recovery())
+	catapult.UseFor("tqtimeout", Timeout(50*time.Millisecond, nil))
+	results := make(chan string, 2)
+	catapult.Delegate("tqmiddleware", func(job *queue.Job, queueName string, c *Catapult) interface{} {
+		panic("delegate panicked")
+	})
+	catapult.Handle("tqtimeout", func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		<-ctx.Done()
+		results <- ctx.Err().Error()
+		return nil, nil
+	})
+	catapult.SetRetryPolicy("tqmiddleware", &queue.RetryPolicy{MaxAttempts: 1})
+	catapult.SetRetryPolicy("tqtimeout", &queue.RetryPolicy{MaxAttempts: 1})
+	panicked, err := catapult.Add("tqmiddleware", "panic", time.Now(), nil)
+	assert.Empty(err)
+	timedOut, err := catapult.Add("tqtimeout", "hang", time.Now(), nil)
+	assert.Empty(err)
+	go catapult.Process("tqmiddleware", 1)
+	go catapult.Process("tqtimeout", 1)
+	time.Sleep(300 * time.Millisecond)
+	// The global middlewares wrap those of the queue, in the order they were added
+	mutex.Lock()
+	assert.ElementsMatch([]string{
+		"first:tqmiddleware", "second:tqmiddleware", "queue:tqmiddleware",
+		"first:tqtimeout", "second:tqtimeout",
+	}, calls)
+	assert.Equal(1, indexOf(calls, "second:tqmiddleware")-indexOf(calls, "first:tqmiddleware"))
+	assert.Equal(1, indexOf(calls, "queue:tqmiddleware")-indexOf(calls, "second:tqmiddleware"))
+	mutex.Unlock()
+	// The panic is turned into an error failing the job
+	result, err := catapult.Result(panicked.ID)
+	assert.Empty(err)
+	assert.Equal("Catapult Error: handler panicked: delegate panicked", result.Error)
+	// The hung job is cancelled and fails
+	assert.Equal(context.DeadlineExceeded.Error(), <-results)
+	result, err = catapult.Result(timedOut.ID)
+	assert.Empty(err)
+	assert.Equal(context.DeadlineExceeded.Error(), result.Error)
+	// Every run is logged
+	handled := l.find("job handled")
+	assert.NotEmpty(handled)
+	assert.Equal(logger.LevelWarn, handled.level)
+	assert.NotEmpty(handled.fields["duration"])
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	assert := assert.New(t)
+	l := &recordingLogger{}
+	job := queue.NewJob("tqtimeout", "stop", time.Now())
+	// A handler stopped by its parent is waited for, not given up on
+	handler := Timeout(time.Hour, l)(func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		<-ctx.Done()
+		return "stopped", nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	value, err := handler(ctx, job)
+	assert.Empty(err)
+	assert.Equal("stopped", value)
+	// The panic of a handler given up on is logged
+	release := make(chan struct{})
+	handler = Timeout(10*time.Millisecond, l)(func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		<-ctx.Done()
+		<-release
+		panic("late panic")
+	})
+	value, err = handler(context.Background(), job)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Empty(value)
+	close(release)
+	assert.Eventually(func() bool {
+		return l.find("job panicked") != nil
+	}, time.Second, 5*time.Millisecond)
+	if event := l.find("job panicked"); event != nil {
+		assert.Equal(logger.LevelError, event.level)
+		assert.Equal("late panic", event.fields["panic"])
+	}
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestJobTimeout(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqtimeout"
+	// Set up a handler hanging on the first attempt, ignoring its context
+	release := make(chan struct{})
+	defer close(release)
+	cancelled := make(chan struct{})
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		if job.Body == "hang" && job.Attempt == 1 {
+			<-ctx.Done()
+			close(cancelled)
+			<-release
+			return nil, nil
+		}
+		if job.Body == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return job.Attempt, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetTimeout(qName, 50*time.Millisecond)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{MaxAttempts: 2})
+	hung, err := catapult.Add(qName, "hang", time.Now(), nil)
+	assert.Empty(err)
+	// Jobs can be given more time than their queue
+	slow, err := catapult.Add(qName, "slow", time.Now(), &queue.AddOptions{Timeout: time.Second})
+	assert.Empty(err)
+	go catapult.Process(qName, 1)
+	// The hung job is cancelled and fails, freeing the worker and the lock for the retry
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("job not cancelled")
+	}
+	result, err := catapult.Wait(context.Background(), hung.ID)
+	assert.Empty(err)
+	var attempt int
+	assert.Empty(result.Decode(&attempt))
+	assert.Equal(2, attempt)
+	job, err := catapult.Inspect(hung.ID)
+	assert.Empty(err)
+	assert.Len(job.Errors, 1)
+	assert.Equal(ErrJobTimeout.Error(), job.Errors[0].Error)
+	result, err = catapult.Wait(context.Background(), slow.ID)
+	assert.Empty(err)
+	assert.Empty(result.Error)
+	assert.Empty(result.Decode(&attempt))
+	assert.Equal(1, attempt)
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqretry"
+	// Set up a handler failing until told otherwise
+	var mutex sync.Mutex
+	attempts := make([]int, 0)
+	failing := true
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts = append(attempts, job.Attempt)
+		if failing {
+			return nil, errors.New("failed")
+		}
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     queue.BackoffExponential,
+		Delay:       50 * time.Millisecond,
+	})
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "retry job", time.Now(), nil)
+	assert.Empty(err)
+	time.Sleep(500 * time.Millisecond)
+	// The job is attempted three times, then dead
+	mutex.Lock()
+	assert.Equal([]int{1, 2, 3}, attempts)
+	mutex.Unlock()
+	count, err := catapult.CountDeadJobs(qName)
+	assert.Empty(err)
+	assert.Equal(1, count)
+	dead, err := catapult.DeadJobs(qName, 0, 10)
+	assert.Empty(err)
+	assert.Len(dead, 1)
+	assert.Equal("retry job", dead[0].Body)
+	assert.Len(dead[0].Errors, 3)
+	assert.Equal("failed", dead[0].Errors[2].Error)
+	assert.Equal(queue.StateDead, dead[0].State)
+	// Replay the dead job
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+	replayed, err := catapult.Replay(dead[0].ID)
+	assert.Empty(err)
+	assert.NotEmpty(replayed)
+	time.Sleep(200 * time.Millisecond)
+	mutex.Lock()
+	assert.Equal([]int{1, 2, 3, 1}, attempts)
+	mutex.Unlock()
+	count, err = catapult.CountDeadJobs(qName)
+	assert.Empty(err)
+	assert.Equal(0, count)
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestJobRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqjobretry"
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		return nil, errors.New("failed")
+	}
+	catapult.Handle(qName, handler)
+	catapult.SetRetryPolicy(qName, &queue.RetryPolicy{
+		MaxAttempts: 3,
+		Delay:       time.Second,
+	})
+	go catapult.Process(qName, 1)
+	// The policy of the job overrides the one of the queue
+	_, err := catapult.AddWithRetry(qName, "retry job", time.Now(), &queue.RetryPolicy{MaxAttempts: 1})
+	assert.Empty(err)
+	time.Sleep(200 * time.Millisecond)
+	dead, err := catapult.DeadJobs(qName, 0, 10)
+	assert.Empty(err)
+	assert.Len(dead, 1)
+	assert.Len(dead[0].Errors, 1)
+	assert.Empty(catapult.RemoveDead(dead[0].ID))
+	count, err := catapult.CountDeadJobs(qName)
+	assert.Empty(err)
+	assert.Equal(0, count)
+}
+
+func TestRecurringJobs(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqrecurring"
+	// Set up a delegate counting the occurrences
+	var mutex sync.Mutex
+	count := 0
+	delegate := func(job *queue.Job, qName string, c *Catapult) interface{} {
+		mutex.Lock()
+		count++
+		mutex.Unlock()
+		return nil
+	}
+	catapult.Delegate(qName, delegate)
+	go catapult.Process(qName, 1)
+	err := catapult.Every("every", qName, time.Second, "recurring job", MisfireFireOnce)
+	assert.Empty(err)
+	err = catapult.Cron("cron", qName, "not a cron", "recurring job", MisfireFireOnce)
+	assert.Equal(schedule.ErrInvalidExpression, err)
+	time.Sleep(3500 * time.Millisecond)
+	// The first tick starts the schedule, then it fires every second
+	mutex.Lock()
+	assert.True(count >= 1 && count <= 3, count)
+	mutex.Unlock()
+}
+
+func TestMisfirePolicy(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	now := time.Now().Truncate(time.Minute).Add(30 * time.Second)
+	every, err := schedule.Every(time.Minute)
+	assert.Empty(err)
+	policies := map[string]MisfirePolicy{
+		"tqmisfireonce": MisfireFireOnce,
+		"tqmisfireall":  MisfireFireAll,
+		"tqmisfireskip": MisfireSkip,
+	}
+	for qName, policy := range policies {
+		job := &RecurringJob{
+			Name:      qName,
+			QueueName: qName,
+			Body:      "recurring job",
+			Schedule:  every,
+			Misfire:   policy,
+		}
+		// Last fired ten minutes ago, so nine occurrences are missed and one is on time
+		err = catapult.store.Set("cron:last:"+qName, strconv.FormatInt(toMillis(now.Add(-10*time.Minute)), 10), 0)
+		assert.Empty(err)
+		assert.Empty(catapult.fire(job, now))
+		// Firing again adds nothing new
+		assert.Empty(catapult.fire(job, now))
+	}
+	expected := map[string]int{
+		"tqmisfireonce": 2,
+		"tqmisfireall":  10,
+		"tqmisfireskip": 1,
+	}
+	for qName, n := range expected {
+		jobs, err := queue.FetchJobsWithTimeout(catapult.broker, qName, 20, 10*time.Millisecond)
+		assert.Empty(err)
+		assert.Len(jobs, n, qName)
+	}
+}
+
+// plainConnectOptions hides the in-place rescheduling of the memory broker
+type plainConnectOptions struct{}
+
+type plainBroker struct {
+	queue.Broker
+}
+
+func (o *plainConnectOptions) NewBroker(rClient *redis.Pool) queue.Broker {
+	return &plainBroker{queue.NewMemoryBroker()}
+}
+
+func testReschedule(t *testing.T, catapult *Catapult) {
+	assert := assert.New(t)
+	qName := "tqreschedule"
+	// Set up a handler recording the ids of the jobs
+	ids := make(chan string, 1)
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		ids <- job.ID
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	job, err := catapult.Add(qName, "reschedule job", time.Now().Add(time.Hour), nil)
+	assert.Empty(err)
+	// Move the job closer, keeping its id
+	eta := time.Now().Add(500 * time.Millisecond)
+	_job, err := catapult.Reschedule(job.ID, eta)
+	assert.Empty(err)
+	assert.Equal(job.ID, _job.ID)
+	_job, err = catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.Equal(job.ID, _job.ID)
+	assert.True(_job.ETA.Equal(eta))
+	assert.True(_job.UpdatedAt.After(job.UpdatedAt))
+	select {
+	case id := <-ids:
+		assert.Equal(job.ID, id)
+	case <-time.After(2 * time.Second):
+		assert.Fail("rescheduled job is not processed")
+	}
+	// Processed jobs cannot be rescheduled
+	time.Sleep(100 * time.Millisecond)
+	_, err = catapult.Reschedule(job.ID, time.Now())
+	assert.Equal(ErrJobNotFound, err)
+}
+
+func TestRescheduleJob(t *testing.T) {
+	catapult := getInstance()
+	defer catapult.Close()
+	testReschedule(t, catapult)
+}
+
+func TestRescheduleJobByReplacing(t *testing.T) {
+	catapult := Connect(&plainConnectOptions{}, nil)
+	defer catapult.Close()
+	testReschedule(t, catapult)
+}
+
+func TestStagedJobs(t *testing.T) {
+	assert := assert.New(t)
+	horizon, interval := StagingHorizon, StagingInterval
+	StagingHorizon, StagingInterval = 500*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		StagingHorizon, StagingInterval = horizon, interval
+	}()
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqstaged"
+	// Set up a handler recording the ids and times of the jobs
+	type run struct {
+		id string
+		at time.Time
+	}
+	runs := make(chan run, 2)
+	handler := func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		runs <- run{job.ID, time.Now()}
+		return nil, nil
+	}
+	catapult.Handle(qName, handler)
+	go catapult.Process(qName, 1)
+	// Jobs beyond the horizon are staged, transparently to Get and Remove
+	eta := time.Now().Add(1500 * time.Millisecond)
+	job, err := catapult.Add(qName, "staged job", eta, nil)
+	assert.Empty(err)
+	assert.Empty(job.MessageID)
+	_job, err := catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.Equal("staged job", _job.Body)
+	removed, err := catapult.Add(qName, "removed job", eta, nil)
+	assert.Empty(err)
+	err = catapult.Remove(removed.ID)
+	assert.Empty(err)
+	_job, err = catapult.Get(removed.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	// Staged jobs are promoted and run on time, keeping their ids
+	time.Sleep(1200 * time.Millisecond)
+	_job, err = catapult.Get(job.ID)
+	assert.Empty(err)
+	assert.NotEmpty(_job)
+	assert.NotEmpty(_job.MessageID)
+	select {
+	case r := <-runs:
+		assert.Equal(job.ID, r.id)
+		assert.False(r.at.Before(eta))
+		assert.True(r.at.Sub(eta) < 100*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		assert.Fail("staged job is not processed")
+	}
+	// Staged jobs can be rescheduled into range
+	job, err = catapult.Add(qName, "rescheduled job", time.Now().Add(time.Hour), nil)
+	assert.Empty(err)
+	_, err = catapult.Reschedule(job.ID, time.Now())
+	assert.Empty(err)
+	select {
+	case r := <-runs:
+		assert.Equal(job.ID, r.id)
+	case <-time.After(2 * time.Second):
+		assert.Fail("rescheduled job is not processed")
+	}
+}
+
+func TestDedupJobs(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqdedup"
+	eta := time.Now().Add(time.Hour)
+	// Duplicates within the window get the existing job
+	window := &queue.AddOptions{DedupKey: "reminder-1", DedupWindow: time.Minute}
+	job, err := catapult.Add(qName, "dedup job", eta, window)
+	assert.Empty(err)
+	duplicate, err := catapult.Add(qName, "dedup job", eta, window)
+	assert.Empty(err)
+	assert.Equal(job.ID, duplicate.ID)
+	// Once the job is gone, duplicates are still refused within the window
+	assert.Empty(catapult.Remove(job.ID))
+	_, err = catapult.Add(qName, "dedup job", eta, window)
+	assert.Equal(ErrDuplicateJob, err)
+	// Unique jobs hold their key only while pending
+	unique := &queue.AddOptions{DedupKey: "reminder-2"}
+	job, err = catapult.Add(qName, "unique job", eta, unique)
+	assert.Empty(err)
+	duplicate, err = catapult.Add(qName, "unique job", eta, unique)
+	assert.Empty(err)
+	assert.Equal(job.ID, duplicate.ID)
+	assert.Empty(catapult.Remove(job.ID))
+	again, err := catapult.Add(qName, "unique job", eta, unique)
+	assert.Empty(err)
+	assert.NotEqual(job.ID, again.ID)
+	// Processed unique jobs let go of their key
+	done := make(chan struct{}, 1)
+	catapult.Handle(qName, func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		done <- struct{}{}
+		return nil, nil
+	})
+	go catapult.Process(qName, 1)
+	_, err = catapult.Reschedule(again.ID, time.Now())
+	assert.Empty(err)
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	last, err := catapult.Add(qName, "unique job", eta, unique)
+	assert.Empty(err)
+	assert.NotEqual(again.ID, last.ID)
+	// Duplicates of a completed job within the window get the completed job
+	window = &queue.AddOptions{DedupKey: "reminder-3", DedupWindow: time.Minute}
+	job, err = catapult.Add(qName, "completed job", time.Now(), window)
+	assert.Empty(err)
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	duplicate, err = catapult.Add(qName, "completed job", time.Now(), window)
+	assert.Empty(err)
+	assert.Equal(job.ID, duplicate.ID)
+	assert.Equal(queue.StateCompleted, duplicate.State)
+}
+
+func TestJobPriorities(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqpriority"
+	// Queue up bulk jobs ahead of an urgent one
+	for i := 0; i < 3; i++ {
+		_, err := catapult.Add(qName, "bulk", time.Now(), nil)
+		assert.Empty(err)
+	}
+	urgent := &queue.AddOptions{PushOptions: queue.PushOptions{Priority: 1}}
+	_, err := catapult.Add(qName, "urgent", time.Now(), urgent)
+	assert.Empty(err)
+	// The urgent job is processed first
+	bodies := make(chan string, 4)
+	catapult.Handle(qName, func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		bodies <- job.Body
+		return nil, nil
+	})
+	go catapult.Process(qName, 1)
+	select {
+	case body := <-bodies:
+		assert.Equal("urgent", body)
+	case <-time.After(2 * time.Second):
+		assert.Fail("jobs are not processed")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	catapult := getInstance()
+	defer catapult.Close()
+	qName := "tqrate"
+	period := 300 * time.Millisecond
+	// Limit each key of the queue to one job per period
+	assert.Equal(ErrInvalidRateLimit, catapult.SetRateLimit(qName, &RateLimit{}))
+	err := catapult.SetRateLimit(qName, &RateLimit{
+		Limit:  1,
+		Period: period,
+		Key: func(job *queue.Job) string {
+			return job.Body
+		},
+	})
+	assert.Empty(err)
+	var mutex sync.Mutex
+	starts := make(map[string][]time.Time)
+	catapult.Handle(qName, func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		starts[job.Body] = append(starts[job.Body], time.Now())
+		return nil, nil
+	})
+	go catapult.Process(qName, 6)
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			_, err := catapult.Add(qName, key, time.Now(), nil)
+			assert.Empty(err)
+		}
+	}
+	time.Sleep(4 * period)
+	// All jobs run, spread over three periods for each key
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, key := range []string{"a", "b"} {
+		if assert.Len(starts[key], 3) {
+			assert.True(starts[key][2].Sub(starts[key][0]) > period/2)
+		}
+	}
+}
+
+func TestRateLimitPostpone(t *testing.T) {
+	assert := assert.New(t)
+	wait := MaxRateLimitWait
+	MaxRateLimitWait = 0
+	defer func() {
+		MaxRateLimitWait = wait
+	}()
+	catapult := getInstance()
+	defer catapult.Close()
+	recorder := tracetest.NewSpanRecorder()
+	catapult.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	qName := "tqratepostpone"
+	err := catapult.SetRateLimit(qName, &RateLimit{Limit: 1, Period: 300 * time.Millisecond})
+	assert.Empty(err)
+	ids := make(chan string, 2)
+	catapult.Handle(qName, func(ctx context.Context, job *queue.Job) (interface{}, error) {
+		ids <- job.ID
+		return nil, nil
+	})
+	go catapult.Process(qName, 2)
+	first, err := catapult.Add(qName, "first", time.Now(), nil)
+	assert.Empty(err)
+	second, err := catapult.Add(qName, "second", time.Now(), nil)
+	assert.Empty(err)
+	// The job over the limit is delayed, keeping its id and attempt
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ids:
+			got[id] = true
+		case <-time.After(2 * time.Second):
+			assert.Fail("postponed job is not processed")
+		}
+	}
+	assert.True(got[first.ID])
+	assert.True(got[second.ID])
+	// The message of the postponed job is acked in the trace too
+	time.Sleep(50 * time.Millisecond)
+	acks := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "ack" {
+			acks++
+		}
+	}
+	assert.Equal(3, acks)
+}
@@ -0,0 +1,205 @@
+package catapult
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"catapult/logger"
+	"catapult/schedule"
+)
+
+// ErrNoSchedule is the error for a recurring job without a schedule
+var ErrNoSchedule = errors.New("Catapult Error: recurring job has no schedule!")
+
+// MisfirePolicy is the policy for occurrences missed while no scheduler was running
+type MisfirePolicy int
+
+const (
+	// MisfireFireOnce enqueues a single job for all the missed occurrences
+	MisfireFireOnce MisfirePolicy = iota
+	// MisfireFireAll enqueues a job for each of the missed occurrences, up to MaxMisfires
+	MisfireFireAll
+	// MisfireSkip drops the missed occurrences
+	MisfireSkip
+)
+
+var (
+	// SchedulerInterval is the interval between checks for due occurrences
+	SchedulerInterval = time.Second
+	// MisfireThreshold is how late an occurrence can be enqueued before it counts as missed
+	MisfireThreshold = time.Minute
+	// MaxMisfires is the maximum number of missed occurrences enqueued by MisfireFireAll
+	MaxMisfires = 1000
+)
+
+// RecurringJob is a job enqueued on a recurring schedule
+type RecurringJob struct {
+	Name      string            // name of the recurring job, unique across all processes
+	QueueName string            // queue the occurrences are added to
+	Body      string            // body of the occurrences
+	Schedule  schedule.Schedule // schedule of the occurrences
+	Misfire   MisfirePolicy     // policy for the occurrences missed during downtime
+}
+
+// Schedule registers a recurring job, starting the scheduler if necessary
+//
+// Every process may register the same recurring jobs; the processes take turns
+// through a lock, and each occurrence is claimed before it is added, so each
+// occurrence is added exactly once across all of them.
+func (c *Catapult) Schedule(job *RecurringJob) error {
+	if job.Schedule == nil {
+		return ErrNoSchedule
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.recurring[job.Name] = job
+	c.scheduling.Do(func() {
+		c.background.Add(1)
+		go c.runScheduler()
+	})
+	return nil
+}
+
+// Cron registers a recurring job on a cron expression, evaluated in UTC
+func (c *Catapult) Cron(name string, queueName string, expr string, body string, misfire MisfirePolicy) error {
+	cron, err := schedule.ParseCron(expr, time.UTC)
+	if err != nil {
+		return err
+	}
+	return c.Schedule(&RecurringJob{
+		Name:      name,
+		QueueName: queueName,
+		Body:      body,
+		Schedule:  cron,
+		Misfire:   misfire,
+	})
+}
+
+// Every registers a recurring job on a fixed interval
+func (c *Catapult) Every(name string, queueName string, interval time.Duration, body string, misfire MisfirePolicy) error {
+	every, err := schedule.Every(interval)
+	if err != nil {
+		return err
+	}
+	return c.Schedule(&RecurringJob{
+		Name:      name,
+		QueueName: queueName,
+		Body:      body,
+		Schedule:  every,
+		Misfire:   misfire,
+	})
+}
+
+// Unschedule removes a recurring job from this process
+func (c *Catapult) Unschedule(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.recurring, name)
+}
+
+// Private functions
+
+func (c *Catapult) runScheduler() {
+	defer c.background.Done()
+	ticker := time.NewTicker(SchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.tick(now)
+		}
+	}
+}
+
+// tick adds the due occurrences of all recurring jobs, if no other process is doing so
+func (c *Catapult) tick(now time.Time) {
+	l := c.newLock(c.prefix+"scheduler", false)
+	l.MaxAttempts = 1
+	result, err := l.Get()
+	if err != nil || !result {
+		return
+	}
+	defer l.Release()
+	c.mutex.Lock()
+	jobs := make([]*RecurringJob, 0, len(c.recurring))
+	for _, job := range c.recurring {
+		jobs = append(jobs, job)
+	}
+	c.mutex.Unlock()
+	for _, job := range jobs {
+		if err := c.fire(job, now); err != nil {
+			c.log().Log(logger.LevelError, "recurring job failed", logger.F("name", job.Name), logger.F("queue", job.QueueName), logger.F("error", err))
+		}
+	}
+}
+
+// fire adds the occurrences of a recurring job due since it last fired
+func (c *Catapult) fire(job *RecurringJob, now time.Time) (err error) {
+	key := "cron:last:" + job.Name
+	value, err := c.store.Get(key)
+	if err != nil {
+		return
+	}
+	// Start from now the first time
+	if value == "" {
+		err = c.store.Set(key, strconv.FormatInt(toMillis(now), 10), 0)
+		return
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return
+	}
+	last := time.Unix(0, ms*int64(time.Millisecond))
+	// Collect the due occurrences, split into missed and on time
+	missed := make([]time.Time, 0)
+	onTime := make([]time.Time, 0)
+	latest := last
+	for t := job.Schedule.Next(last); !t.IsZero() && !t.After(now); t = job.Schedule.Next(t) {
+		latest = t
+		if now.Sub(t) > MisfireThreshold {
+			missed = append(missed, t)
+			if len(missed) > MaxMisfires {
+				missed = missed[1:]
+			}
+		} else {
+			onTime = append(onTime, t)
+		}
+	}
+	if latest.Equal(last) {
+		return
+	}
+	// Apply the misfire policy
+	occurrences := make([]time.Time, 0, len(missed)+len(onTime))
+	switch job.Misfire {
+	case MisfireFireAll:
+		occurrences = append(occurrences, missed...)
+	case MisfireFireOnce:
+		if len(missed) > 0 {
+			occurrences = append(occurrences, missed[len(missed)-1])
+		}
+	}
+	occurrences = append(occurrences, onTime...)
+	// Claim and add each occurrence
+	for _, t := range occurrences {
+		claim := "cron:fired:" + job.Name + ":" + strconv.FormatInt(toMillis(t), 10)
+		var claimed bool
+		claimed, err = c.store.SetNX(claim, "1", 24*time.Hour)
+		if err != nil {
+			return
+		}
+		if !claimed {
+			continue
+		}
+		_, err = c.Add(job.QueueName, job.Body, t, nil)
+		if err != nil {
+			// Let the occurrence be added again on the next tick
+			_ = c.store.Delete(claim)
+			return
+		}
+	}
+	err = c.store.Set(key, strconv.FormatInt(toMillis(latest), 10), 0)
+	return
+}
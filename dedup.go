@@ -0,0 +1,94 @@
+package catapult
+
+import (
+	"errors"
+	"time"
+
+	"catapult/queue"
+)
+
+// ErrDuplicateJob is the error for a job whose duplicate was added and is no longer found
+var ErrDuplicateJob = errors.New("Catapult Error: job with the same dedup key is already added!")
+
+// Private functions
+
+// addOnce adds a job unless a job with the same dedup key was added, in which case
+// that job is returned instead
+//
+// The dedup key is claimed in the store before the job is pushed, pointing at the
+// id the job is given upfront. With a window, the claim expires after the window;
+// otherwise it is released once the job is done or removed.
+func (c *Catapult) addOnce(job *queue.Job, options *queue.AddOptions) (added *queue.Job, err error) {
+	job.ID, err = newJobID("D")
+	if err != nil {
+		return
+	}
+	key := c.getKeyForDedup(job.QueueName, options.DedupKey)
+	ttl := options.DedupWindow
+	if ttl == 0 {
+		// Let the claim go with a job dropped by the broker
+		ttl = dropTTL(job, time.Now())
+	}
+	// Claim the dedup key
+	claimed, err := c.store.SetNX(key, job.ID, ttl)
+	if err != nil {
+		return
+	}
+	if !claimed {
+		added, err = c.getDuplicate(key)
+		return
+	}
+	err = c.enqueue(job)
+	if err != nil {
+		_ = c.store.Delete(key)
+		return
+	}
+	c.transition(job, queue.StateScheduled, stateNone)
+	c.getMetrics().JobEnqueued(job.QueueName)
+	c.emit(EventAdded, job, nil)
+	added = job
+	return
+}
+
+// getDuplicate gets the job holding a dedup key
+//
+// A job that is done is found by its record, kept for ResultTTL once completed.
+func (c *Catapult) getDuplicate(key string) (job *queue.Job, err error) {
+	id, err := c.store.Get(key)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		job, err = c.Get(id)
+		if err != nil {
+			return
+		}
+	}
+	if job == nil && id != "" {
+		job, err = c.Inspect(id)
+		if err != nil {
+			return
+		}
+	}
+	if job == nil {
+		err = ErrDuplicateJob
+	}
+	return
+}
+
+// release lets go of the dedup key held by a job that is done or removed
+func (c *Catapult) release(job *queue.Job) {
+	if job.UniqueKey == "" {
+		return
+	}
+	key := c.getKeyForDedup(job.QueueName, job.UniqueKey)
+	// Only let go of the key if it is still held by the job
+	id, err := c.store.Get(key)
+	if err == nil && id == job.ID {
+		_ = c.store.Delete(key)
+	}
+}
+
+func (c *Catapult) getKeyForDedup(queueName string, key string) string {
+	return "dedup:" + queueName + ":" + key
+}
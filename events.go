@@ -0,0 +1,189 @@
+package catapult
+
+import (
+	"encoding/json"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// EventType is the type of a lifecycle event of a job
+type EventType string
+
+// Types of the lifecycle events of the jobs
+const (
+	EventAdded     EventType = "added"     // the job was added to its queue
+	EventStarted   EventType = "started"   // the handler started on the job
+	EventSucceeded EventType = "succeeded" // the handler returned without an error
+	EventFailed    EventType = "failed"    // the handler returned an error or panicked
+	EventRetried   EventType = "retried"   // the next attempt of a failed job was scheduled
+	EventDead      EventType = "dead"      // the job ran out of attempts and was dead-lettered
+	EventLockLost  EventType = "lock_lost" // the lock on the job was lost while it was processed
+)
+
+// Event is a lifecycle event of a job
+type Event struct {
+	Type   EventType
+	Job    *queue.Job // snapshot of the job when the event happened
+	Error  string     `json:",omitempty"` // error of the attempt, for failed and dead jobs
+	At     time.Time
+	Origin string // id of the catapult the event happened in
+	Remote bool   `json:"-"` // whether the event was broadcast by another catapult
+}
+
+// Listener is a function called with the lifecycle events of the jobs
+type Listener func(Event)
+
+// Listen registers a listener for the events of the types, or of all types if none
+// are given, returning a function that unregisters it
+//
+// Listeners are called in the order they were registered, on the goroutine the event
+// happened on, so they should return quickly. Panics in listeners are logged.
+func (c *Catapult) Listen(fn Listener, types ...EventType) (cancel func()) {
+	l := &listener{
+		fn:    fn,
+		types: make(map[EventType]bool),
+	}
+	for _, t := range types {
+		l.types[t] = true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.listeners = append(c.listeners, l)
+	cancel = func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for i, registered := range c.listeners {
+			if registered == l {
+				c.listeners = append(c.listeners[:i:i], c.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+	return
+}
+
+// BroadcastEvents turns the broadcast of the events over pub/sub on or off
+//
+// While on, the events of the catapult are published to the other catapults sharing
+// its redis, and the events they broadcast are delivered to its listeners, marked as
+// remote. Events published while a catapult is not subscribed are missed.
+func (c *Catapult) BroadcastEvents(enabled bool) (err error) {
+	c.broadcasting.Lock()
+	defer c.broadcasting.Unlock()
+	if !enabled {
+		c.stopBroadcast()
+		return
+	}
+	if c.broadcastDone != nil {
+		return
+	}
+	messages, cancel, err := c.store.Subscribe(c.getKeyForEvents())
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	c.broadcastDone = done
+	c.mutex.Lock()
+	c.broadcast = cancel
+	c.mutex.Unlock()
+	go c.receive(messages, done)
+	return
+}
+
+// Private functions
+
+// listener is a registered listener and the types of the events it listens to
+type listener struct {
+	fn    Listener
+	types map[EventType]bool // all types if empty
+}
+
+// emit delivers an event about a job to the listeners, and broadcasts it if on
+func (c *Catapult) emit(t EventType, job *queue.Job, cause error) {
+	snapshot := *job
+	event := Event{
+		Type:   t,
+		Job:    &snapshot,
+		At:     time.Now(),
+		Origin: c.origin,
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+	c.deliver(event)
+	if !c.isBroadcasting() {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	err = c.store.Publish(c.getKeyForEvents(), string(data))
+	if err != nil {
+		c.log().Log(logger.LevelError, "event broadcast failed", jobFields(job, logger.F("event", t), logger.F("error", err))...)
+	}
+}
+
+// deliver calls the listeners of an event
+func (c *Catapult) deliver(event Event) {
+	c.mutex.Lock()
+	listeners := c.listeners
+	c.mutex.Unlock()
+	for _, l := range listeners {
+		if len(l.types) > 0 && !l.types[event.Type] {
+			continue
+		}
+		c.call(l.fn, event)
+	}
+}
+
+// call calls a listener, logging its panics
+func (c *Catapult) call(fn Listener, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log().Log(logger.LevelError, "event listener panicked", logger.F("event", event.Type), logger.F("panic", r))
+		}
+	}()
+	fn(event)
+}
+
+// receive delivers the events broadcast by the other catapults until unsubscribed
+func (c *Catapult) receive(messages <-chan string, done chan struct{}) {
+	defer close(done)
+	for message := range messages {
+		var event Event
+		err := json.Unmarshal([]byte(message), &event)
+		if err != nil || event.Job == nil || event.Origin == c.origin {
+			continue
+		}
+		event.Remote = true
+		c.deliver(event)
+	}
+}
+
+// stopBroadcast unsubscribes from the events of the other catapults, waiting for the
+// events received to be delivered
+func (c *Catapult) stopBroadcast() {
+	if c.broadcastDone == nil {
+		return
+	}
+	c.mutex.Lock()
+	cancel := c.broadcast
+	c.broadcast = nil
+	c.mutex.Unlock()
+	cancel()
+	<-c.broadcastDone
+	c.broadcastDone = nil
+}
+
+func (c *Catapult) isBroadcasting() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.broadcast != nil
+}
+
+func (c *Catapult) getKeyForEvents() string {
+	return "events"
+}
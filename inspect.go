@@ -0,0 +1,145 @@
+package catapult
+
+import (
+	"math"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// Jobs lists the jobs of a queue in a state, between from and to, ordered by time
+//
+// Pending and active jobs are ordered by their ETA, and completed and dead jobs by
+// when they were done. A zero from or to leaves the range open on that side, and
+// count < 0 lists all jobs from the offset. Jobs dropped while they are listed are
+// skipped, so a page can come out short.
+func (c *Catapult) Jobs(queueName string, state queue.State, from time.Time, to time.Time, offset int, count int) (jobs []*queue.Job, err error) {
+	jobs = make([]*queue.Job, 0)
+	key, min, max := c.getRangeForState(queueName, state, from, to)
+	ids, err := c.store.ZRangeByScore(key, min, max, offset, count)
+	if err != nil {
+		return
+	}
+	jobs, err = c.inspectAll(key, ids)
+	return
+}
+
+// CountJobs counts the jobs of a queue in each state
+func (c *Catapult) CountJobs(queueName string) (counts map[queue.State]int, err error) {
+	counts = make(map[queue.State]int)
+	var n int
+	for _, state := range queue.States {
+		key, min, max := c.getRangeForState(queueName, state, time.Time{}, time.Time{})
+		n, err = c.store.ZCount(key, min, max)
+		if err != nil {
+			return
+		}
+		counts[state] = n
+	}
+	return
+}
+
+// JobsByTag lists the jobs given a tag when added, in any state, oldest first
+//
+// count < 0 lists all jobs from the offset. Jobs that are removed, or completed
+// longer than ResultTTL ago, are not found.
+func (c *Catapult) JobsByTag(tag string, offset int, count int) (jobs []*queue.Job, err error) {
+	jobs = make([]*queue.Job, 0)
+	key := c.getKeyForTag(tag)
+	ids, err := c.store.ZRangeByScore(key, math.Inf(-1), math.Inf(1), offset, count)
+	if err != nil {
+		return
+	}
+	jobs, err = c.inspectAll(key, ids)
+	return
+}
+
+// Private functions
+
+// inspectAll gets the records of the jobs listed in an index, dropping the jobs
+// whose records are gone from it
+func (c *Catapult) inspectAll(key string, ids []string) (jobs []*queue.Job, err error) {
+	jobs = make([]*queue.Job, 0, len(ids))
+	var job *queue.Job
+	for _, id := range ids {
+		job, err = c.Inspect(id)
+		if err != nil {
+			return
+		}
+		if job == nil {
+			_, _ = c.store.ZRem(key, id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+// tag indexes a job by its tags
+func (c *Catapult) tag(job *queue.Job) {
+	for _, tag := range job.Tags {
+		_ = c.store.ZAdd(c.getKeyForTag(tag), float64(toMillis(job.CreatedAt)), job.ID)
+	}
+}
+
+// untag drops a job from the indexes of its tags
+func (c *Catapult) untag(job *queue.Job) {
+	for _, tag := range job.Tags {
+		_, _ = c.store.ZRem(c.getKeyForTag(tag), job.ID)
+	}
+}
+
+// countDepth counts the jobs per state of the queues with a handler, for the metrics
+func (c *Catapult) countDepth() map[string]map[string]int {
+	c.mutex.Lock()
+	queueNames := make([]string, 0, len(c.Handlers))
+	for queueName := range c.Handlers {
+		queueNames = append(queueNames, queueName)
+	}
+	c.mutex.Unlock()
+	depth := make(map[string]map[string]int)
+	for _, queueName := range queueNames {
+		counts, err := c.CountJobs(queueName)
+		if err != nil {
+			c.log().Log(logger.LevelError, "job count failed", logger.F("queue", queueName), logger.F("error", err))
+			continue
+		}
+		depth[queueName] = make(map[string]int)
+		for state, n := range counts {
+			depth[queueName][string(state)] = n
+		}
+	}
+	return depth
+}
+
+// getRangeForState gets the index of the jobs of a queue in a state, and the range
+// of scores of the jobs in the state between from and to
+//
+// Scheduled and queued jobs share an index, told apart by whether they are due.
+func (c *Catapult) getRangeForState(queueName string, state queue.State, from time.Time, to time.Time) (key string, min float64, max float64) {
+	min, max = math.Inf(-1), math.Inf(1)
+	if !from.IsZero() {
+		min = float64(toMillis(from))
+	}
+	if !to.IsZero() {
+		max = float64(toMillis(to))
+	}
+	now := time.Now()
+	switch state {
+	case queue.StateScheduled:
+		min = math.Max(min, float64(toMillis(now)+1))
+	case queue.StateQueued:
+		max = math.Min(max, float64(toMillis(now)))
+		state = queue.StateScheduled
+	case queue.StateCompleted:
+		// Leave out the jobs whose records expired
+		min = math.Max(min, float64(toMillis(now.Add(-ResultTTL))))
+	}
+	key = c.getKeyForState(queueName, state)
+	return
+}
+
+func (c *Catapult) getKeyForTag(tag string) string {
+	return "tag:" + tag
+}
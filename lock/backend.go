@@ -0,0 +1,140 @@
+package lock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Backend is the storage a lock is kept in
+type Backend interface {
+	// Acquire sets the key to the value if it is not set, expiring after duration
+	Acquire(key string, value string, duration time.Duration) (bool, error)
+	// Extend resets the expiry of the key if it is still set to the value
+	Extend(key string, value string, duration time.Duration) (bool, error)
+	// Release clears the key if it is still set to the value
+	Release(key string, value string) error
+}
+
+// RedisBackend keeps locks in redis
+type RedisBackend struct {
+	Client *redis.Pool // the redis client
+}
+
+// NewRedisBackend creates a lock backend on a redis pool
+func NewRedisBackend(client *redis.Pool) *RedisBackend {
+	return &RedisBackend{
+		Client: client,
+	}
+}
+
+// Acquire sets the key to the value with SET NX PX
+func (b *RedisBackend) Acquire(key string, value string, duration time.Duration) (bool, error) {
+	conn := b.Client.Get()
+	defer conn.Close()
+	reply, err := redis.String(conn.Do("SET", key, value, "NX", "PX", int(duration/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// Extend resets the expiry of the key if it is still set to the value
+func (b *RedisBackend) Extend(key string, value string, duration time.Duration) (bool, error) {
+	conn := b.Client.Get()
+	defer conn.Close()
+	reply, err := redis.String(extendLock.Do(conn, key, value, int(duration/time.Millisecond)))
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// Release clears the key if it is still set to the value
+func (b *RedisBackend) Release(key string, value string) error {
+	conn := b.Client.Get()
+	defer conn.Close()
+	_, err := releaseLock.Do(conn, key, value)
+	return err
+}
+
+// MemoryBackend keeps locks in process memory
+type MemoryBackend struct {
+	mutex sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	value string
+	until time.Time
+}
+
+// NewMemoryBackend creates an in-memory lock backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		locks: make(map[string]memoryLock),
+	}
+}
+
+// Acquire sets the key to the value if it is not set or expired
+func (b *MemoryBackend) Acquire(key string, value string, duration time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	if current, exists := b.locks[key]; exists && now.Before(current.until) {
+		return false, nil
+	}
+	b.locks[key] = memoryLock{
+		value: value,
+		until: now.Add(duration),
+	}
+	return true, nil
+}
+
+// Extend resets the expiry of the key if it is still set to the value
+func (b *MemoryBackend) Extend(key string, value string, duration time.Duration) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	current, exists := b.locks[key]
+	if !exists || current.value != value || !now.Before(current.until) {
+		return false, nil
+	}
+	current.until = now.Add(duration)
+	b.locks[key] = current
+	return true, nil
+}
+
+// Release clears the key if it is still set to the value
+func (b *MemoryBackend) Release(key string, value string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if current, exists := b.locks[key]; exists && current.value == value {
+		delete(b.locks, key)
+	}
+	return nil
+}
+
+// Redis script for releasing lock
+var releaseLockScript = `
+  if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+  else
+    return 0
+  end
+`
+var releaseLock = redis.NewScript(1, releaseLockScript)
+
+// Redis script for extending lock
+var extendLockScript = `
+  if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("SET", KEYS[1], ARGV[1], "XX", "PX", ARGV[2])
+  else
+    return "ERR"
+  end
+`
+var extendLock = redis.NewScript(1, extendLockScript)
@@ -4,11 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+
+	"catapult/logger"
+	"catapult/metrics"
 )
 
 const (
@@ -47,11 +49,16 @@ type Lock struct {
 	Delay       time.Duration // delay between attempts
 	AutoRenew   bool          // whether to auto renew the lock
 
-	Client *redis.Pool // the redis client
+	Client  *redis.Pool      // the redis client
+	Backend Backend          // the backend the lock is kept in
+	Logger  logger.Logger    // the logger of the lock events, logger.Default() if nil
+	Metrics *metrics.Metrics // the metrics the lock is counted in, nil for none
 
-	value string     // random string used as the value of the lock
-	until time.Time  // timestamp at which the lock expires
-	mutex sync.Mutex // internal mutex for updates
+	value    string        // random string used as the value of the lock
+	until    time.Time     // timestamp at which the lock expires
+	released chan struct{} // closed when the lock is released
+	lost     chan struct{} // closed when the lock is lost during auto renewal
+	mutex    sync.Mutex    // internal mutex for updates
 
 	ARControl chan string // auto renew control channel
 	ARResult  chan string // auto renew result channel
@@ -59,6 +66,13 @@ type Lock struct {
 
 // NewLockOnKey creates a lock struct (unacquired) on a key
 func NewLockOnKey(client *redis.Pool, key string, ar bool) *Lock {
+	lock := NewLockWithBackend(NewRedisBackend(client), key, ar)
+	lock.Client = client
+	return lock
+}
+
+// NewLockWithBackend creates a lock struct (unacquired) on a key kept in the backend
+func NewLockWithBackend(backend Backend, key string, ar bool) *Lock {
 	lock := &Lock{
 		Key:         key,
 		Duration:    DefaultDuration,
@@ -66,7 +80,7 @@ func NewLockOnKey(client *redis.Pool, key string, ar bool) *Lock {
 		MaxAttempts: DefaultAttempts,
 		Delay:       DefaultDelay,
 		AutoRenew:   ar,
-		Client:      client,
+		Backend:     backend,
 		ARControl:   make(chan string, 1),
 		ARResult:    make(chan string, 1),
 	}
@@ -84,9 +98,6 @@ func (l *Lock) Get() (bool, error) {
 		return false, err
 	}
 	value := base64.StdEncoding.EncodeToString(raw)
-	// Get a redis connection from the pool
-	conn := l.Client.Get()
-	defer conn.Close()
 	// Start the process
 	for i := 0; i < l.MaxAttempts; i++ {
 		// Wait between attempts
@@ -95,13 +106,13 @@ func (l *Lock) Get() (bool, error) {
 		}
 		// Start a timer to adjust for lost time during acquisition
 		start := time.Now()
-		duration := int(l.Duration / time.Millisecond)
-		reply, err := redis.String(conn.Do("SET", l.Key, value, "NX", "PX", duration))
+		l.Metrics.LockAttempt()
+		acquired, err := l.Backend.Acquire(l.Key, value, l.Duration)
 		// If anything fails, try again
 		if err != nil {
 			continue
 		}
-		if reply != "OK" {
+		if !acquired {
 			continue
 		}
 		// Calculate real duration for lock
@@ -109,102 +120,142 @@ func (l *Lock) Get() (bool, error) {
 		// Update the lock internal values
 		l.value = value
 		l.until = until
-		l.mutex.Unlock()
+		l.released = make(chan struct{})
+		l.lost = make(chan struct{})
 		// Start auto renewal if specified
 		if l.AutoRenew {
-			go l.autoRenew()
+			go l.autoRenew(value, l.released)
 		}
+		l.mutex.Unlock()
 		// Lock is now acquired
 		return true, nil
 	}
 	// Fail to acquire after max attempts
+	l.Metrics.LockFailed()
 	l.mutex.Unlock()
 	return false, ErrLockFailedAfterMaxAttempts
 }
 
 // Release revokes the lock on the key
 func (l *Lock) Release() {
-	// If lock is not acquired or released, do nothing
-	if l.value == "" {
-		return
-	}
-	// Signal auto renew to stop
-	if l.AutoRenew {
-		l.ARControl <- LockARCommandStop
-	}
 	// Pick up the internal mutext
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
-	// Check lock status again
+	// If lock is not acquired, released or lost, do nothing
 	if l.value == "" {
 		return
 	}
+	// Signal auto renew to stop
+	close(l.released)
 	// Clear the lock
-	conn := l.Client.Get()
-	defer conn.Close()
-	_, _ = releaseLock.Do(conn, l.Key, l.value)
+	_ = l.Backend.Release(l.Key, l.value)
 	// Clear internal
 	l.value = ""
 	return
 }
 
+// Lost returns a channel that is closed if the lock is lost during auto renewal
+//
+// Once the channel is closed, the key may be locked by someone else, so the holder
+// should stop the work done under the lock. The channel is not closed when the lock
+// is released, and is nil before the lock is acquired.
+func (l *Lock) Lost() <-chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lost
+}
+
 // Private functions
 
-// AutoRenew
-func (l *Lock) autoRenew() {
-	// Run forever
+// AutoRenew renews the lock acquired with the value until it is released or lost
+func (l *Lock) autoRenew(value string, released chan struct{}) {
+	// Sleep till next renewal time
+	wait := time.Duration(int64(float64(l.Duration) * 0.5))
 	for {
+		timer := time.NewTimer(wait)
 		select {
 		// Check commands
 		case command := <-l.ARControl:
+			timer.Stop()
 			if command == LockARCommandStop {
-				l.ARResult <- LockARSignalStopSuccess
-				return
-			}
-		// By default, sleep until renewal time
-		default:
-			// Sleep till next renewal time
-			sleepDuration := time.Duration(int64(float64(l.Duration) * 0.5))
-			time.Sleep(sleepDuration)
-			// After wake up, check if lock is released
-			if l.value == "" {
+				select {
+				case l.ARResult <- LockARSignalStopSuccess:
+				default:
+				}
 				return
 			}
+		case <-released:
+			timer.Stop()
+			return
+		case <-timer.C:
 			// Extend lock
-			result, err := l.extend(l.Duration)
-			// If failed, panic so that the upstream function knows to stop
-			if err != nil {
-				fmt.Println(err)
-				panic(ErrLockLost)
+			result, err := l.extend(value, l.Duration)
+			l.Metrics.LockRenewed(result)
+			if result {
+				wait = time.Duration(int64(float64(l.Duration) * 0.5))
+				continue
 			}
-			if !result {
-				panic(ErrLockLost)
+			// If the extension failed on an error, try again while the lock holds
+			if err != nil {
+				l.log().Log(logger.LevelWarn, "lock extension failed", logger.F("key", l.Key), logger.F("error", err))
+				if time.Now().Add(l.Delay).Before(l.expiry(value)) {
+					wait = l.Delay
+					continue
+				}
 			}
+			// Otherwise let the holder know that the lock is lost
+			l.lose(value)
+			return
 		}
 	}
 }
 
-// Extend the lock
-func (l *Lock) extend(duration time.Duration) (result bool, err error) {
+// lose marks the lock acquired with the value as lost, unless it was released meanwhile
+func (l *Lock) lose(value string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.value != value {
+		return
+	}
+	l.log().Log(logger.LevelError, "lock lost", logger.F("key", l.Key), logger.F("error", ErrLockLost))
+	l.value = ""
+	close(l.lost)
+}
+
+func (l *Lock) log() logger.Logger {
+	if l.Logger == nil {
+		return logger.Default()
+	}
+	return l.Logger
+}
+
+// expiry returns when the lock acquired with the value expires
+func (l *Lock) expiry(value string) time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.value != value {
+		return time.Time{}
+	}
+	return l.until
+}
+
+// Extend the lock acquired with the value
+func (l *Lock) extend(value string, duration time.Duration) (result bool, err error) {
 	// Pick up the internal mutext
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	// If lock is not acquired or released, do nothing
 	result = false
-	if l.value == "" {
+	if l.value != value {
 		return
 	}
-	// Get a redis connection from the pool
-	conn := l.Client.Get()
-	defer conn.Close()
 	// Extend the lock on the key
 	start := time.Now()
-	extension := int(duration / time.Millisecond)
-	reply, err := extendLock.Do(conn, l.Key, l.value, extension)
+	extended, err := l.Backend.Extend(l.Key, l.value, duration)
 	if err != nil {
 		return
 	}
-	if reply != "OK" {
+	if !extended {
 		return
 	}
 	// Update the lock
@@ -213,23 +264,3 @@ func (l *Lock) extend(duration time.Duration) (result bool, err error) {
 	result = true
 	return
 }
-
-// Redis script for releasing lock
-var releaseLockScript = `
-  if redis.call("GET", KEYS[1]) == ARGV[1] then
-    return redis.call("DEL", KEYS[1])
-  else
-    return 0
-  end
-`
-var releaseLock = redis.NewScript(1, releaseLockScript)
-
-// Redis script for extending lock
-var extendLockScript = `
-  if redis.call("GET", KEYS[1]) == ARGV[1] then
-    return redis.call("SET", KEYS[1], ARGV[1], "XX", "PX", ARGV[2])
-  else
-    return "ERR"
-  end
-`
-var extendLock = redis.NewScript(1, extendLockScript)
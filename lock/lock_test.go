@@ -10,7 +10,7 @@ import (
 
 var keyPrefix = "tq:l:"
 
-func getClient() *redis.Pool {
+func getClient(t *testing.T) *redis.Pool {
 	client := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
@@ -27,12 +27,19 @@ func getClient() *redis.Pool {
 			return conn, nil
 		},
 	}
+	// Skip redis tests if redis is not available
+	conn := client.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		client.Close()
+		t.Skip("redis is not available: ", err)
+	}
 	return client
 }
 
 func TestGetLock(t *testing.T) {
 	assert := assert.New(t)
-	client := getClient()
+	client := getClient(t)
 	defer client.Close()
 	key := keyPrefix + "getlock"
 	lock := NewLockOnKey(client, key, false)
@@ -55,7 +62,7 @@ func TestGetLock(t *testing.T) {
 
 func TestAutoRenew(t *testing.T) {
 	assert := assert.New(t)
-	client := getClient()
+	client := getClient(t)
 	defer client.Close()
 	// Create lock
 	key := keyPrefix + "autorenew"
@@ -82,7 +89,7 @@ func TestAutoRenew(t *testing.T) {
 
 func TestMutualExclusion(t *testing.T) {
 	assert := assert.New(t)
-	client := getClient()
+	client := getClient(t)
 	defer client.Close()
 	// Create first lock
 	key := keyPrefix + "mutex"
@@ -112,3 +119,95 @@ func TestMutualExclusion(t *testing.T) {
 func TestRelease(t *testing.T) {
 
 }
+
+func TestMemoryGetLock(t *testing.T) {
+	assert := assert.New(t)
+	backend := NewMemoryBackend()
+	key := keyPrefix + "getlock"
+	lock := NewLockWithBackend(backend, key, false)
+	assert.NotEmpty(lock)
+	defer lock.Release()
+	lock.Duration = 500 * time.Millisecond
+	result, err := lock.Get()
+	assert.Empty(err)
+	assert.True(result)
+	// Lock is held by the value
+	acquired, err := backend.Acquire(key, "other", lock.Duration)
+	assert.Empty(err)
+	assert.False(acquired)
+	// Lock expires after the duration
+	time.Sleep(lock.Duration)
+	acquired, err = backend.Acquire(key, "other", lock.Duration)
+	assert.Empty(err)
+	assert.True(acquired)
+}
+
+func TestMemoryAutoRenew(t *testing.T) {
+	assert := assert.New(t)
+	backend := NewMemoryBackend()
+	key := keyPrefix + "autorenew"
+	lock := NewLockWithBackend(backend, key, true)
+	defer lock.Release()
+	lock.Duration = 500 * time.Millisecond
+	result, err := lock.Get()
+	assert.Empty(err)
+	assert.True(result)
+	// Wait after the normal duration
+	time.Sleep(2 * lock.Duration)
+	// Lock should still be valid
+	extended, err := backend.Extend(key, lock.value, lock.Duration)
+	assert.Empty(err)
+	assert.True(extended)
+}
+
+func TestMemoryLockLost(t *testing.T) {
+	assert := assert.New(t)
+	backend := NewMemoryBackend()
+	key := keyPrefix + "lost"
+	lock := NewLockWithBackend(backend, key, true)
+	defer lock.Release()
+	lock.Duration = 200 * time.Millisecond
+	result, err := lock.Get()
+	assert.Empty(err)
+	assert.True(result)
+	// Take the lock over
+	err = backend.Release(key, lock.value)
+	assert.Empty(err)
+	acquired, err := backend.Acquire(key, "other", time.Second)
+	assert.Empty(err)
+	assert.True(acquired)
+	// The loss is reported on the next renewal
+	select {
+	case <-lock.Lost():
+	case <-time.After(2 * lock.Duration):
+		assert.Fail("lock loss is not reported")
+	}
+	// Releasing a lost lock leaves the new holder alone
+	lock.Release()
+	extended, err := backend.Extend(key, "other", time.Second)
+	assert.Empty(err)
+	assert.True(extended)
+}
+
+func TestMemoryMutualExclusion(t *testing.T) {
+	assert := assert.New(t)
+	backend := NewMemoryBackend()
+	key := keyPrefix + "mutex"
+	lock1 := NewLockWithBackend(backend, key, true)
+	defer lock1.Release()
+	result, err := lock1.Get()
+	assert.Empty(err)
+	assert.True(result)
+	// Should not be able to acquire second lock
+	lock2 := NewLockWithBackend(backend, key, true)
+	lock2.MaxAttempts = 2
+	defer lock2.Release()
+	result, err = lock2.Get()
+	assert.False(result)
+	assert.Equal(err, ErrLockFailedAfterMaxAttempts)
+	// Can acquire once the first is released
+	lock1.Release()
+	result, err = lock2.Get()
+	assert.Empty(err)
+	assert.True(result)
+}
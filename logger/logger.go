@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Level is the severity of an event
+type Level int
+
+const (
+	// LevelDebug is the level of routine events, e.g. a job starting
+	LevelDebug Level = iota
+	// LevelInfo is the level of notable events
+	LevelInfo
+	// LevelWarn is the level of failures that are handled, e.g. a job failing an attempt
+	LevelWarn
+	// LevelError is the level of failures that need attention, e.g. a lost lock
+	LevelError
+)
+
+// Field is a named value attached to an event
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the events of catapult
+type Logger interface {
+	// Log emits an event at the level with the fields
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Nop is a logger dropping all events
+var Nop Logger = nop{}
+
+// F creates a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// SlogLogger is a logger emitting the events to a log/slog logger
+type SlogLogger struct {
+	Logger *slog.Logger // the slog logger, slog.Default() if nil
+}
+
+// NewSlog creates a logger emitting the events to a log/slog logger
+func NewSlog(l *slog.Logger) *SlogLogger {
+	return &SlogLogger{
+		Logger: l,
+	}
+}
+
+// Default returns the logger used unless another is set, which emits the events to slog.Default()
+func Default() Logger {
+	return &SlogLogger{}
+}
+
+// Log emits an event, mapping the fields to slog attributes
+func (l *SlogLogger) Log(level Level, msg string, fields ...Field) {
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, field := range fields {
+		attrs[i] = slog.Any(field.Key, field.Value)
+	}
+	logger.LogAttrs(context.Background(), toSlogLevel(level), msg, attrs...)
+}
+
+// Private functions
+
+type nop struct{}
+
+func (nop) Log(level Level, msg string, fields ...Field) {}
+
+func toSlogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
@@ -0,0 +1,31 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	assert := assert.New(t)
+	var buffer bytes.Buffer
+	handler := slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelInfo})
+	l := NewSlog(slog.New(handler))
+	// Events below the level of the handler are dropped
+	l.Log(LevelDebug, "job started", F("queue", "tq"))
+	assert.Empty(buffer.String())
+	l.Log(LevelWarn, "job failed", F("queue", "tq"), F("attempt", 2), F("duration", time.Second), F("error", errors.New("failed")))
+	event := map[string]interface{}{}
+	assert.Empty(json.Unmarshal(buffer.Bytes(), &event))
+	assert.Equal("WARN", event["level"])
+	assert.Equal("job failed", event["msg"])
+	assert.Equal("tq", event["queue"])
+	assert.Equal(float64(2), event["attempt"])
+	assert.Equal(float64(time.Second), event["duration"])
+	assert.Equal("failed", event["error"])
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultNamespace is the default namespace of the metrics
+const DefaultNamespace = "catapult"
+
+// Outcomes of a processed job
+const (
+	OutcomeCompleted   = "completed"
+	OutcomeFailed      = "failed"
+	OutcomeInterrupted = "interrupted"
+)
+
+// Metrics is the Prometheus collectors of the queues, workers and locks
+//
+// A nil *Metrics records nothing, so that the metrics are optional. Metrics is a
+// prometheus.Collector itself, to be registered on a registry as a whole.
+type Metrics struct {
+	Enqueued     *prometheus.CounterVec   // jobs added, by queue
+	Processed    *prometheus.CounterVec   // jobs processed, by queue and outcome
+	Retried      *prometheus.CounterVec   // retries scheduled, by queue
+	Dead         *prometheus.CounterVec   // jobs out of attempts, by queue
+	InFlight     *prometheus.GaugeVec     // jobs being processed, by queue
+	Duration     *prometheus.HistogramVec // duration of the handlers, by queue
+	Lag          *prometheus.HistogramVec // time between the ETA of the jobs and their start, by queue
+	LockAttempts prometheus.Counter       // attempts to acquire a lock
+	LockFailures prometheus.Counter       // locks that could not be acquired after all attempts
+	LockRenewals *prometheus.CounterVec   // renewals of the locks, by result
+
+	depth        *prometheus.Desc
+	depthCounter func() map[string]map[string]int
+	mutex        sync.Mutex
+}
+
+// New creates the collectors in the namespace, DefaultNamespace if empty
+func New(namespace string) *Metrics {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &Metrics{
+		Enqueued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_enqueued_total",
+			Help:      "Number of jobs added.",
+		}, []string{"queue"}),
+		Processed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_processed_total",
+			Help:      "Number of jobs processed, by outcome.",
+		}, []string{"queue", "outcome"}),
+		Retried: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_retried_total",
+			Help:      "Number of retries scheduled for failed jobs.",
+		}, []string{"queue"}),
+		Dead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_dead_total",
+			Help:      "Number of jobs moved to the dead-letter queue.",
+		}, []string{"queue"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "jobs_in_flight",
+			Help:      "Number of jobs being processed.",
+		}, []string{"queue"}),
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "job_duration_seconds",
+			Help:      "Duration of the handlers.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"queue"}),
+		Lag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "job_schedule_lag_seconds",
+			Help:      "Time between the ETA of the jobs and their start.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"queue"}),
+		LockAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lock_attempts_total",
+			Help:      "Number of attempts to acquire a lock.",
+		}),
+		LockFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lock_failures_total",
+			Help:      "Number of locks not acquired after all attempts.",
+		}),
+		LockRenewals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "lock_renewals_total",
+			Help:      "Number of renewals of the locks, by result.",
+		}, []string{"result"}),
+		depth: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "queue_jobs"),
+			"Number of jobs per queue and state.",
+			[]string{"queue", "state"}, nil,
+		),
+	}
+}
+
+// Handler creates an HTTP handler exposing the metrics on a registry of their own
+func (m *Metrics) Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// SetDepthCounter sets the function counting the jobs per queue and state on every collection
+func (m *Metrics) SetDepthCounter(fn func() map[string]map[string]int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.depthCounter = fn
+}
+
+// Describe sends the descriptors of the collectors
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+	ch <- m.depth
+}
+
+// Collect sends the metrics of the collectors, counting the jobs per queue and state
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+	m.mutex.Lock()
+	counter := m.depthCounter
+	m.mutex.Unlock()
+	if counter == nil {
+		return
+	}
+	for queueName, states := range counter() {
+		for state, n := range states {
+			ch <- prometheus.MustNewConstMetric(m.depth, prometheus.GaugeValue, float64(n), queueName, state)
+		}
+	}
+}
+
+// JobEnqueued records a job added to the queue
+func (m *Metrics) JobEnqueued(queueName string) {
+	if m == nil {
+		return
+	}
+	m.Enqueued.WithLabelValues(queueName).Inc()
+}
+
+// JobStarted records a job of the queue starting, lag after its ETA
+func (m *Metrics) JobStarted(queueName string, lag time.Duration) {
+	if m == nil {
+		return
+	}
+	if lag < 0 {
+		lag = 0
+	}
+	m.InFlight.WithLabelValues(queueName).Inc()
+	m.Lag.WithLabelValues(queueName).Observe(lag.Seconds())
+}
+
+// JobFinished records a job of the queue finishing with the outcome after running for duration
+func (m *Metrics) JobFinished(queueName string, outcome string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.InFlight.WithLabelValues(queueName).Dec()
+	m.Duration.WithLabelValues(queueName).Observe(duration.Seconds())
+	m.Processed.WithLabelValues(queueName, outcome).Inc()
+}
+
+// JobRetried records a retry scheduled for a job of the queue
+func (m *Metrics) JobRetried(queueName string) {
+	if m == nil {
+		return
+	}
+	m.Retried.WithLabelValues(queueName).Inc()
+}
+
+// JobDead records a job of the queue moved to the dead-letter queue
+func (m *Metrics) JobDead(queueName string) {
+	if m == nil {
+		return
+	}
+	m.Dead.WithLabelValues(queueName).Inc()
+}
+
+// LockAttempt records an attempt to acquire a lock
+func (m *Metrics) LockAttempt() {
+	if m == nil {
+		return
+	}
+	m.LockAttempts.Inc()
+}
+
+// LockFailed records a lock not acquired after all attempts
+func (m *Metrics) LockFailed() {
+	if m == nil {
+		return
+	}
+	m.LockFailures.Inc()
+}
+
+// LockRenewed records a renewal of a lock
+func (m *Metrics) LockRenewed(ok bool) {
+	if m == nil {
+		return
+	}
+	result := "renewed"
+	if !ok {
+		result = "failed"
+	}
+	m.LockRenewals.WithLabelValues(result).Inc()
+}
+
+// Private functions
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.Enqueued, m.Processed, m.Retried, m.Dead, m.InFlight, m.Duration, m.Lag,
+		m.LockAttempts, m.LockFailures, m.LockRenewals,
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilMetrics(t *testing.T) {
+	assert := assert.New(t)
+	var m *Metrics
+	// A nil *Metrics records nothing
+	assert.NotPanics(func() {
+		m.JobEnqueued("q")
+		m.JobStarted("q", time.Second)
+		m.JobFinished("q", OutcomeCompleted, time.Second)
+		m.JobRetried("q")
+		m.JobDead("q")
+		m.LockAttempt()
+		m.LockFailed()
+		m.LockRenewed(true)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	m := New("test")
+	m.JobStarted("q", -time.Second)
+	assert.Equal(float64(1), testutil.ToFloat64(m.InFlight.WithLabelValues("q")))
+	m.JobFinished("q", OutcomeFailed, time.Second)
+	assert.Equal(float64(0), testutil.ToFloat64(m.InFlight.WithLabelValues("q")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.Processed.WithLabelValues("q", OutcomeFailed)))
+	m.LockRenewed(true)
+	m.LockRenewed(false)
+	assert.Equal(float64(1), testutil.ToFloat64(m.LockRenewals.WithLabelValues("renewed")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.LockRenewals.WithLabelValues("failed")))
+	m.SetDepthCounter(func() map[string]map[string]int {
+		return map[string]map[string]int{"q": {"queued": 2}}
+	})
+	// The handler exposes the metrics, the depth included
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	assert.Empty(err)
+	assert.Contains(string(body), `test_queue_jobs{queue="q",state="queued"} 2`)
+	assert.Contains(string(body), `test_jobs_processed_total{outcome="failed",queue="q"} 1`)
+	assert.Contains(string(body), `test_job_schedule_lag_seconds_count{queue="q"} 1`)
+}
@@ -0,0 +1,170 @@
+package catapult
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// Middleware wraps a handler, e.g. to run code around each job of a queue
+type Middleware func(HandlerFunction) HandlerFunction
+
+// PanicError is the error a handler panic is turned into by Recovery
+type PanicError struct {
+	Value interface{} // value the handler panicked with
+	Stack []byte      // stack of the handler when it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Catapult Error: handler panicked: %v", e.Value)
+}
+
+// Use adds middlewares wrapping the handlers of all queues
+//
+// Middlewares wrap the handlers in the order they are added, the first one being
+// outermost, and apply to the queues processed after they are added.
+func (c *Catapult) Use(middlewares ...Middleware) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.middleware = append(c.middleware, middlewares...)
+}
+
+// UseFor adds middlewares wrapping the handler of a queue, inside those of all queues
+func (c *Catapult) UseFor(queueName string, middlewares ...Middleware) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.queueChain[queueName] = append(c.queueChain[queueName], middlewares...)
+}
+
+// Recovery creates a middleware turning the panics of the handlers into *PanicError
+// errors, which fail the job like any other error
+func Recovery() Middleware {
+	return func(next HandlerFunction) HandlerFunction {
+		return func(ctx context.Context, job *queue.Job) (value interface{}, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					value = nil
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+			value, err = next(ctx, job)
+			return
+		}
+	}
+}
+
+// Timeout creates a middleware failing the jobs whose handlers run longer than d
+//
+// The context of the handler is cancelled after d, and the job fails with
+// context.DeadlineExceeded. Panics of handlers that ran out of time are logged to l,
+// or to slog.Default() if l is nil.
+func Timeout(d time.Duration, l logger.Logger) Middleware {
+	if l == nil {
+		l = logger.Default()
+	}
+	return func(next HandlerFunction) HandlerFunction {
+		return func(ctx context.Context, job *queue.Job) (interface{}, error) {
+			return runWithin(ctx, job, next, d, context.DeadlineExceeded, l)
+		}
+	}
+}
+
+// Logging creates a middleware logging every run of the handlers, with its duration
+// and error, to l, or to slog.Default() if l is nil
+func Logging(l logger.Logger) Middleware {
+	if l == nil {
+		l = logger.Default()
+	}
+	return func(next HandlerFunction) HandlerFunction {
+		return func(ctx context.Context, job *queue.Job) (value interface{}, err error) {
+			started := time.Now()
+			value, err = next(ctx, job)
+			fields := jobFields(job, logger.F("duration", time.Since(started)))
+			if err != nil {
+				l.Log(logger.LevelWarn, "job handled", append(fields, logger.F("error", err))...)
+				return
+			}
+			l.Log(logger.LevelInfo, "job handled", fields...)
+			return
+		}
+	}
+}
+
+// Private functions
+
+// chain wraps the handler of a queue in its middlewares, with the mutex held
+func (c *Catapult) chain(queueName string, handler HandlerFunction) HandlerFunction {
+	middlewares := append(append([]Middleware{}, c.middleware...), c.queueChain[queueName]...)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// runWithin runs a handler on a job, giving up on it with cause once timeout elapses
+//
+// The context of the handler is cancelled with cause then. A handler ignoring its
+// context is left to run to the end in the background, and its outcome is dropped;
+// if it panics, the panic is logged to l instead. Panics of handlers that finish in
+// time are passed on to the caller.
+func runWithin(ctx context.Context, job *queue.Job, fn HandlerFunction, timeout time.Duration, cause error, l logger.Logger) (value interface{}, err error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, cause)
+	defer cancel()
+	type outcome struct {
+		value    interface{}
+		err      error
+		panicked interface{}
+	}
+	// The outcome is either handed over in time, or reported once given up on
+	var mutex sync.Mutex
+	givenUp := false
+	done := make(chan outcome, 1)
+	go func() {
+		var o outcome
+		defer func() {
+			o.panicked = recover()
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !givenUp {
+				done <- o
+				return
+			}
+			if o.panicked != nil {
+				l.Log(logger.LevelError, "job panicked", jobFields(job, logger.F("panic", o.panicked))...)
+			}
+		}()
+		o.value, o.err = fn(ctx, job)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var o outcome
+	select {
+	case o = <-done:
+	case <-timer.C:
+		// Let the deadline of the context pass first, so the handler sees it
+		<-ctx.Done()
+		mutex.Lock()
+		givenUp = true
+		select {
+		case o = <-done:
+			if o.panicked != nil {
+				l.Log(logger.LevelError, "job panicked", jobFields(job, logger.F("panic", o.panicked))...)
+			}
+		default:
+		}
+		mutex.Unlock()
+		err = cause
+		return
+	}
+	// Pass the panics on to the worker
+	if o.panicked != nil {
+		panic(o.panicked)
+	}
+	value, err = o.value, o.err
+	return
+}
@@ -0,0 +1,349 @@
+package catapult
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"catapult/queue"
+)
+
+// SharedFetchTimeout is the fetch timeout while the workers are shared between queues
+var SharedFetchTimeout = 100 * time.Millisecond
+
+// QueueOptions is the parameters for processing a queue
+type QueueOptions struct {
+	Concurrency int // number of jobs of the queue processed at the same time
+	Weight      int // share of the shared workers the queue gets when competing with other queues
+	Priority    int // queues of higher priority are given the shared workers first
+}
+
+// processor runs the workers of a single queue
+type processor struct {
+	queueName string
+	options   QueueOptions
+	handler   HandlerFunction
+
+	mutex    sync.Mutex
+	paused   chan struct{} // closed when resumed, nil if not paused
+	stopping chan struct{} // closed when asked to stop
+	stopped  chan struct{} // closed when all workers are done
+
+	ctx     context.Context    // context of the handlers
+	cancel  context.CancelFunc // cancels the handlers
+	fetches sync.WaitGroup     // fetches still running after the processor stopped
+
+	held int // shared worker slots held, guarded by the dispatcher
+}
+
+func newProcessor(queueName string, options QueueOptions, handler HandlerFunction) *processor {
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+	if options.Weight < 1 {
+		options.Weight = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &processor{
+		queueName: queueName,
+		options:   options,
+		handler:   handler,
+		stopping:  make(chan struct{}),
+		stopped:   make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// run fetches jobs for idle workers until the processor is stopped
+//
+// Jobs are only fetched for idle workers, so no job waits in the pipeline for a
+// busy worker while its lock and visibility timeout tick away.
+func (p *processor) run(c *Catapult) {
+	concurrency := p.options.Concurrency
+	// Start the workers, each handing back its slots when done with a job
+	jobs := make(chan *queue.Job, concurrency)
+	slots := make(chan struct{}, concurrency)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		slots <- struct{}{}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				c.process(p.ctx, job, p.queueName, p.handler)
+				slots <- struct{}{}
+				c.dispatcher.release(p, 1)
+			}
+		}()
+	}
+	// Let the workers finish once stopped
+	defer func() {
+		close(jobs)
+		workers.Wait()
+		p.cancel()
+		close(p.stopped)
+	}()
+	for {
+		// Wait while paused
+		if resumed := p.pausedChan(); resumed != nil {
+			select {
+			case <-resumed:
+				continue
+			case <-p.stopping:
+				return
+			}
+		}
+		// Wait for an idle worker
+		select {
+		case <-p.stopping:
+			return
+		case <-slots:
+		}
+		// Take all other idle workers as well
+		n := 1
+	idle:
+		for n < concurrency {
+			select {
+			case <-slots:
+				n++
+			default:
+				break idle
+			}
+		}
+		// Get as many of the shared workers as possible
+		k := c.dispatcher.acquire(p, n, p.stopping)
+		for i := k; i < n; i++ {
+			slots <- struct{}{}
+		}
+		if k == 0 {
+			return
+		}
+		// Fetch jobs from the queue for the idle workers; while the workers are
+		// shared, only wait briefly so that an empty queue does not hold them
+		results := make(chan []*queue.Job, 1)
+		p.fetches.Add(1)
+		go func(limited bool) {
+			defer p.fetches.Done()
+			var fetched []*queue.Job
+			var err error
+			if limited {
+				fetched, err = queue.FetchJobsWithTimeout(c.broker, p.queueName, k, SharedFetchTimeout)
+			} else {
+				fetched, err = queue.FetchJobs(c.broker, p.queueName, k)
+			}
+			if err != nil {
+				fetched = nil
+			}
+			results <- fetched
+		}(c.dispatcher.limited())
+		var fetched []*queue.Job
+		select {
+		case fetched = <-results:
+		case <-p.stopping:
+			// Stop without waiting for the fetch, giving its jobs back once it returns
+			p.fetches.Add(1)
+			go func() {
+				defer p.fetches.Done()
+				for _, job := range <-results {
+					_ = c.nack(c.jobContext(context.Background(), job), job.MessageID)
+				}
+			}()
+			c.dispatcher.release(p, k)
+			return
+		}
+		// Give the jobs back if paused or stopped during the fetch
+		if p.pausedChan() != nil || p.isStopping() {
+			for _, job := range fetched {
+				_ = c.nack(c.jobContext(context.Background(), job), job.MessageID)
+			}
+			fetched = nil
+		}
+		for _, job := range fetched {
+			jobs <- job
+		}
+		// Give back the slots that got no job
+		for i := len(fetched); i < k; i++ {
+			slots <- struct{}{}
+		}
+		c.dispatcher.release(p, k-len(fetched))
+	}
+}
+
+func (p *processor) pause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused == nil {
+		p.paused = make(chan struct{})
+	}
+}
+
+func (p *processor) resume() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.paused != nil {
+		close(p.paused)
+		p.paused = nil
+	}
+}
+
+func (p *processor) pausedChan() chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.paused
+}
+
+func (p *processor) isStopping() bool {
+	select {
+	case <-p.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop asks the processor to stop, cancelling the running handlers, and waits until all workers are done
+func (p *processor) stop() {
+	p.drain()
+	p.cancel()
+	<-p.stopped
+}
+
+// drain asks the processor to stop fetching, letting the running handlers finish
+func (p *processor) drain() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.stopping:
+	default:
+		close(p.stopping)
+	}
+}
+
+// dispatcher shares a limited number of workers between the processors
+//
+// When the processors compete for the workers, those of higher priority are
+// served first, and among the same priority the processor holding the smallest
+// number of workers relative to its weight is served first.
+type dispatcher struct {
+	mutex   sync.Mutex
+	limit   int // maximum number of workers, 0 for no limit
+	used    int
+	waiting []*dispatchRequest
+}
+
+type dispatchRequest struct {
+	p       *processor
+	n       int
+	granted chan int
+}
+
+// acquire blocks until at least one and up to n workers are given to the processor,
+// returning 0 if cancelled before that
+func (d *dispatcher) acquire(p *processor, n int, cancel <-chan struct{}) int {
+	d.mutex.Lock()
+	if d.limit <= 0 {
+		d.used += n
+		p.held += n
+		d.mutex.Unlock()
+		return n
+	}
+	r := &dispatchRequest{
+		p:       p,
+		n:       n,
+		granted: make(chan int, 1),
+	}
+	d.waiting = append(d.waiting, r)
+	d.grant()
+	d.mutex.Unlock()
+	select {
+	case k := <-r.granted:
+		return k
+	case <-cancel:
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		for i, w := range d.waiting {
+			if w == r {
+				d.waiting = append(d.waiting[:i], d.waiting[i+1:]...)
+				return 0
+			}
+		}
+		// Granted in the meantime, give it back
+		k := <-r.granted
+		d.used -= k
+		p.held -= k
+		d.grant()
+		return 0
+	}
+}
+
+// release gives back k workers held by the processor
+func (d *dispatcher) release(p *processor, k int) {
+	if k == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.used -= k
+	p.held -= k
+	d.grant()
+}
+
+func (d *dispatcher) limited() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.limit > 0
+}
+
+func (d *dispatcher) setLimit(limit int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.limit = limit
+	if limit <= 0 {
+		// Serve everyone waiting
+		for _, r := range d.waiting {
+			d.used += r.n
+			r.p.held += r.n
+			r.granted <- r.n
+		}
+		d.waiting = nil
+		return
+	}
+	d.grant()
+}
+
+// grant gives the free workers to the waiting processors
+func (d *dispatcher) grant() {
+	for d.used < d.limit && len(d.waiting) > 0 {
+		// Pick the processor to serve next
+		best := 0
+		totalWeight := 0
+		for i, r := range d.waiting {
+			totalWeight += r.p.options.Weight
+			b := d.waiting[best]
+			if r.p.options.Priority != b.p.options.Priority {
+				if r.p.options.Priority > b.p.options.Priority {
+					best = i
+				}
+				continue
+			}
+			if r.p.held*b.p.options.Weight < b.p.held*r.p.options.Weight {
+				best = i
+			}
+		}
+		r := d.waiting[best]
+		// Give it its share of the free workers
+		free := d.limit - d.used
+		k := free * r.p.options.Weight / totalWeight
+		if k < 1 {
+			k = 1
+		}
+		if k > r.n {
+			k = r.n
+		}
+		d.used += k
+		r.p.held += k
+		d.waiting = append(d.waiting[:best], d.waiting[best+1:]...)
+		r.granted <- k
+	}
+}
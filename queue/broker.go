@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Message is a job message as stored by a broker
+type Message struct {
+	ID        string      // id assigned by the broker
+	QueueName string      // name of the queue the message belongs to
+	Data      string      // serialized job data
+	Raw       interface{} // backend specific details of the message
+}
+
+// Broker is the interface of a job queue backend
+type Broker interface {
+	// Push adds a message to the queue, to be delivered no earlier than delay from now;
+	// options may be nil
+	Push(queueName string, data string, delay time.Duration, options *PushOptions) (id string, err error)
+	// Fetch gets up to n due messages from the queue, waiting up to timeout for them
+	Fetch(queueName string, n int, timeout time.Duration) (messages []*Message, err error)
+	// Ack acknowledges the message as processed
+	Ack(id string) error
+	// Nack gives the message back to the queue for redelivery
+	Nack(id string) error
+	// Get gets a message using the id, returning nil if it does not exist
+	Get(id string) (message *Message, err error)
+	// Delete removes a message using the id
+	Delete(id string) error
+	// Close shuts down the broker
+	Close()
+}
+
+// Rescheduler is implemented by brokers that can move a pending message in place
+type Rescheduler interface {
+	// Reschedule replaces the data and delay of a message that is not in flight,
+	// returning false if it does not exist or is in flight
+	Reschedule(id string, data string, delay time.Duration) (ok bool, err error)
+}
+
+// Private functions
+
+func newJobID(prefix string) (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(raw), nil
+}
+
+// rank orders a job that became ready at a time among the other ready jobs
+//
+// Each level of priority counts as having waited for the aging already, so higher
+// priorities go first, while a job of lower priority is passed over only until it
+// has waited the aging for each level of difference.
+func rank(since time.Time, priority int, aging time.Duration) time.Time {
+	return since.Add(-time.Duration(priority) * aging)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
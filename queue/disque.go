@@ -3,14 +3,106 @@ package queue
 import (
 	"errors"
 	"golang.org/x/net/context"
+	"strconv"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/zencoder/disque-go/disque"
 )
 
 // ErrNoConnection is the error thrown when no connection options are provided
 var ErrNoConnection = errors.New("Disque Error: no client nor connection is provided!")
 
+// DisqueBroker is a broker backed by disque
+//
+// Disque delivers the jobs of a queue in its own order, so their priorities are ignored.
+type DisqueBroker struct {
+	Client *disque.DisquePool
+}
+
+// NewDisqueBroker creates a broker on a disque pool
+func NewDisqueBroker(client *disque.DisquePool) *DisqueBroker {
+	return &DisqueBroker{
+		Client: client,
+	}
+}
+
+// Push adds a job to disque, using the delay as the DELAY option
+//
+// DELAY is in seconds, so the delay is rounded down and the job may be delivered up
+// to a second early; the rest of the delay is left to the consumer.
+func (b *DisqueBroker) Push(queueName string, data string, delay time.Duration, pushOptions *PushOptions) (id string, err error) {
+	timeout, _ := time.ParseDuration(JobTimeout)
+	options := make(map[string]string)
+	if delay > 0 {
+		options["DELAY"] = strconv.Itoa(int(delay.Seconds()))
+	}
+	if pushOptions != nil {
+		if pushOptions.TTL > 0 {
+			// TTL counts from now, and is rounded up to keep the job until its ETA plus TTL
+			ttl := delay + pushOptions.TTL
+			options["TTL"] = strconv.Itoa(int((ttl + time.Second - 1) / time.Second))
+		}
+		if pushOptions.MaxLen > 0 {
+			options["MAXLEN"] = strconv.Itoa(pushOptions.MaxLen)
+		}
+		if pushOptions.Replicate > 0 {
+			options["REPLICATE"] = strconv.Itoa(pushOptions.Replicate)
+		}
+		if pushOptions.Async {
+			options["ASYNC"] = "true"
+		}
+	}
+	id, err = addJob(b.Client, nil, queueName, data, timeout, &options)
+	return
+}
+
+// Fetch gets jobs from disque that are due for processing
+func (b *DisqueBroker) Fetch(queueName string, n int, timeout time.Duration) (messages []*Message, err error) {
+	messages = make([]*Message, 0)
+	details, err := fetchJobs(b.Client, nil, queueName, n, timeout)
+	if err != nil {
+		return
+	}
+	for _, segment := range details {
+		messages = append(messages, fromDetails(segment))
+	}
+	return
+}
+
+// Ack sends an ACK about a job to disque
+func (b *DisqueBroker) Ack(id string) error {
+	return ackJob(b.Client, nil, id)
+}
+
+// Nack sends an NACK about a job to disque
+func (b *DisqueBroker) Nack(id string) error {
+	return nackJob(b.Client, nil, id)
+}
+
+// Get gets the details of a job from disque
+func (b *DisqueBroker) Get(id string) (message *Message, err error) {
+	details, err := getJob(b.Client, nil, id)
+	if err != nil {
+		if err == redis.ErrNil {
+			err = nil
+		}
+		return
+	}
+	message = fromDetails(details)
+	return
+}
+
+// Delete removes a job from disque
+func (b *DisqueBroker) Delete(id string) error {
+	return removeJob(b.Client, nil, id)
+}
+
+// Close shuts down the disque pool
+func (b *DisqueBroker) Close() {
+	b.Client.Close()
+}
+
 // Producer functions
 
 func addJob(client *disque.DisquePool, conn *disque.Disque, queueName string, data string, timeout time.Duration, options *map[string]string) (id string, err error) {
@@ -23,7 +115,7 @@ func addJob(client *disque.DisquePool, conn *disque.Disque, queueName string, da
 	} else if conn == nil {
 		panic(ErrNoConnection)
 	}
-	if _, val := (*options)["RETRY"]; val {
+	if _, exists := (*options)["RETRY"]; !exists {
 		(*options)["RETRY"] = "5"
 	}
 	id, err = conn.PushWithOptions(queueName, data, timeout, *options)
@@ -115,3 +207,12 @@ func ackJob(client *disque.DisquePool, conn *disque.Disque, id string) (err erro
 	err = conn.Ack(id)
 	return
 }
+
+func fromDetails(details *disque.JobDetails) *Message {
+	return &Message{
+		ID:        details.JobId,
+		QueueName: details.QueueName,
+		Data:      details.Message,
+		Raw:       details,
+	}
+}
@@ -2,11 +2,7 @@ package queue
 
 import (
 	"encoding/json"
-	"strconv"
 	"time"
-
-	"github.com/garyburd/redigo/redis"
-	"github.com/zencoder/disque-go/disque"
 )
 
 // JobTimeout is the default job timeout
@@ -17,129 +13,238 @@ var FetchTimeout = "10s"
 
 // Job is the job struct
 type Job struct {
-	ID        string
+	ID        string // stable id of the job, kept when it is rescheduled or retried
+	MessageID string // id of the message currently carrying the job in the broker
 	QueueName string
 	Body      string
 	ETA       time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
-	Raw       *disque.JobDetails
+	Attempt   int               // number of the current attempt, starting from 1
+	Retry     *RetryPolicy      // retry policy of the job, overriding the one of the queue
+	Timeout   time.Duration     // time the job may run before it fails, overriding the timeout of the queue
+	Errors    []JobError        // errors of the failed attempts
+	Headers   map[string]string // custom headers carried with the job
+	Push      *PushOptions      // options handed to the broker whenever the job is pushed
+	UniqueKey string            // dedup key held by the job for as long as it is pending
+	Tags      []string          // custom tags the job can be found by
+	Trace     map[string]string // trace context of the producer, as injected by a propagator
+	Raw       interface{}       `json:"-"` // backend specific details, e.g. *disque.JobDetails
+
+	State       State        `json:",omitempty"` // state of the job, as tracked by the catapult
+	Transitions []Transition `json:",omitempty"` // changes of the state of the job, oldest first
 }
 
 // Data is a wrapper struct for the job's data
 type Data struct {
+	ID        string `json:",omitempty"`
 	Body      string
 	ETA       time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	Attempt   int               `json:",omitempty"`
+	Retry     *RetryPolicy      `json:",omitempty"`
+	Timeout   time.Duration     `json:",omitempty"`
+	Errors    []JobError        `json:",omitempty"`
+	Headers   map[string]string `json:",omitempty"`
+	Push      *PushOptions      `json:",omitempty"`
+	UniqueKey string            `json:",omitempty"`
+	Tags      []string          `json:",omitempty"`
+	Trace     map[string]string `json:",omitempty"`
 }
 
-// AddJob adds a job to the queue
-func AddJob(client *disque.DisquePool, queueName string, body string, ETA time.Time, options *map[string]string) (job *Job, err error) {
-	// Construct the job
-	job = &Job{
+// NewJob constructs a job (unpushed) for the queue
+func NewJob(queueName string, body string, ETA time.Time) *Job {
+	now := time.Now()
+	return &Job{
 		QueueName: queueName,
+		Body:      body,
 		ETA:       ETA,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Attempt:   1,
+	}
+}
+
+// AddJob adds a job to the queue with the options, which may be nil
+func AddJob(broker Broker, queueName string, body string, ETA time.Time, options *AddOptions) (job *Job, err error) {
+	// Construct the job
+	job, err = NewJobWithOptions(queueName, body, ETA, options)
+	if err != nil {
+		return
+	}
+	err = PushJob(broker, job)
+	if err != nil {
+		job = nil
 	}
-	timeout, _ := time.ParseDuration(JobTimeout)
+	return
+}
+
+// NewJobWithOptions constructs a job (unpushed) for the queue, validating and applying the options
+func NewJobWithOptions(queueName string, body string, ETA time.Time, options *AddOptions) (job *Job, err error) {
+	if options != nil {
+		err = options.Validate()
+		if err != nil {
+			return
+		}
+	}
+	job = NewJob(queueName, body, ETA)
+	if options != nil {
+		options.Apply(job)
+	}
+	return
+}
+
+// PushJob pushes a constructed job to its queue, to be processed at its ETA
+//
+// The job is given the id assigned by the broker as its message id, and as its
+// id as well unless it already has one.
+func PushJob(broker Broker, job *Job) (err error) {
 	// Calculate the delay
-	now := time.Now()
-	job.CreatedAt = now
-	job.UpdatedAt = now
-	delay := ETA.Sub(now).Seconds()
-	_options := make(map[string]string)
-	if delay > 0 {
-		_options["DELAY"] = strconv.Itoa(int(delay))
-	}
-	data, _ := json.Marshal(
-		&Data{
-			Body:      body,
-			ETA:       ETA,
-			CreatedAt: now,
-			UpdatedAt: now,
-		},
-	)
-	id, err := addJob(client, nil, queueName, string(data), timeout, &_options)
+	delay := job.ETA.Sub(time.Now())
+	data, err := toData(job)
+	if err != nil {
+		return
+	}
+	id, err := broker.Push(job.QueueName, data, delay, job.Push)
 	if err != nil {
 		return
 	}
-	job.ID = id
-	job.Body = body
+	job.MessageID = id
+	if job.ID == "" {
+		job.ID = id
+	}
 	return
 }
 
-// GetJob gets a job from the queue using the id
-func GetJob(client *disque.DisquePool, id string) (job *Job, err error) {
-	// Get the job details
-	details, err := getJob(client, nil, id)
+// RescheduleJob moves a pending job in place to its current ETA
+func RescheduleJob(broker Rescheduler, job *Job) (ok bool, err error) {
+	// Calculate the delay
+	delay := job.ETA.Sub(time.Now())
+	data, err := toData(job)
 	if err != nil {
-		if err == redis.ErrNil {
-			err = nil
-		}
 		return
 	}
-	// Construct job from details
-	job, err = fromDetails(details)
+	ok, err = broker.Reschedule(job.MessageID, data, delay)
+	return
+}
+
+// GetJob gets a job from the queue using the id
+func GetJob(broker Broker, id string) (job *Job, err error) {
+	// Get the job message
+	message, err := broker.Get(id)
+	if err != nil || message == nil {
+		return
+	}
+	// Construct job from message
+	job, err = fromMessage(message)
 	return
 }
 
 // RemoveJob removes a job from the queue using the id
-func RemoveJob(client *disque.DisquePool, id string) (err error) {
-	err = removeJob(client, nil, id)
+func RemoveJob(broker Broker, id string) (err error) {
+	err = broker.Delete(id)
 	return
 }
 
 // FetchJobs gets jobs from the queue that are due for processing
-func FetchJobs(client *disque.DisquePool, queueName string, n int) (jobs []*Job, err error) {
+func FetchJobs(broker Broker, queueName string, n int) (jobs []*Job, err error) {
+	timeout, _ := time.ParseDuration(FetchTimeout)
+	jobs, err = FetchJobsWithTimeout(broker, queueName, n, timeout)
+	return
+}
+
+// FetchJobsWithTimeout gets jobs from the queue that are due for processing, waiting up to timeout for them
+func FetchJobsWithTimeout(broker Broker, queueName string, n int, timeout time.Duration) (jobs []*Job, err error) {
 	jobs = make([]*Job, 0)
 	// Fetch jobs from queue
-	timeout, _ := time.ParseDuration(FetchTimeout)
-	details, err := fetchJobs(client, nil, queueName, n, timeout)
+	messages, err := broker.Fetch(queueName, n, timeout)
 	if err != nil {
 		return
 	}
-	// Construct jobs from details
+	// Construct jobs from messages
 	var job *Job
-	for _, segment := range details {
-		job, err = fromDetails(segment)
+	for _, message := range messages {
+		job, err = fromMessage(message)
 		if err != nil {
 			// Nack faulty jobs, then skip
-			_ = nackJob(client, nil, segment.JobId)
+			_ = broker.Nack(message.ID)
 			continue
 		}
 		jobs = append(jobs, job)
 	}
+	err = nil
 	return
 }
 
 // NackJob sends an NACK about a job to the queue
-func NackJob(client *disque.DisquePool, id string) (err error) {
-	err = nackJob(client, nil, id)
+func NackJob(broker Broker, id string) (err error) {
+	err = broker.Nack(id)
 	return
 }
 
 // AckJob sends an ACK about a job to the queue
-func AckJob(client *disque.DisquePool, id string) (err error) {
-	err = ackJob(client, nil, id)
+func AckJob(broker Broker, id string) (err error) {
+	err = broker.Ack(id)
 	return
 }
 
 // Private functions
 
-func fromDetails(details *disque.JobDetails) (job *Job, err error) {
+func toData(job *Job) (string, error) {
+	data, err := json.Marshal(
+		&Data{
+			ID:        job.ID,
+			Body:      job.Body,
+			ETA:       job.ETA,
+			CreatedAt: job.CreatedAt,
+			UpdatedAt: job.UpdatedAt,
+			Attempt:   job.Attempt,
+			Retry:     job.Retry,
+			Timeout:   job.Timeout,
+			Errors:    job.Errors,
+			Headers:   job.Headers,
+			Push:      job.Push,
+			UniqueKey: job.UniqueKey,
+			Tags:      job.Tags,
+			Trace:     job.Trace,
+		},
+	)
+	return string(data), err
+}
+
+func fromMessage(message *Message) (job *Job, err error) {
 	var data Data
-	err = json.Unmarshal([]byte(details.Message), &data)
+	err = json.Unmarshal([]byte(message.Data), &data)
 	if err != nil {
 		return
 	}
 	job = &Job{
-		ID:        details.JobId,
-		QueueName: details.QueueName,
+		ID:        data.ID,
+		MessageID: message.ID,
+		QueueName: message.QueueName,
 		Body:      data.Body,
 		ETA:       data.ETA,
 		CreatedAt: data.CreatedAt,
 		UpdatedAt: data.UpdatedAt,
-		Raw:       details,
+		Attempt:   data.Attempt,
+		Retry:     data.Retry,
+		Timeout:   data.Timeout,
+		Errors:    data.Errors,
+		Headers:   data.Headers,
+		Push:      data.Push,
+		UniqueKey: data.UniqueKey,
+		Tags:      data.Tags,
+		Trace:     data.Trace,
+		Raw:       message.Raw,
+	}
+	// Jobs that were never moved go by the id of their message
+	if job.ID == "" {
+		job.ID = message.ID
+	}
+	// Jobs pushed before attempts were counted are on their first
+	if job.Attempt == 0 {
+		job.Attempt = 1
 	}
 	return
 }
@@ -0,0 +1,318 @@
+package queue
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is a broker keeping jobs in process memory
+//
+// Jobs of each queue are kept in a heap of delayed jobs ordered by ETA, and moved to
+// a heap of ready jobs ordered by rank once due. Fetched jobs stay in flight until
+// they are acked or nacked, and are given back to the ready heap once the visibility
+// timeout passes, so the delivery semantics match the other brokers.
+type MemoryBroker struct {
+	VisibilityTimeout time.Duration // time a fetched job stays in flight before it is requeued
+	PriorityAging     time.Duration // wait that makes up for one level of priority
+
+	mutex  sync.Mutex
+	jobs   map[string]*memoryJob
+	queues map[string]*memoryQueue
+	wake   chan struct{} // closed and replaced whenever jobs are given to the heaps
+	closed bool
+}
+
+type memoryJob struct {
+	message  *Message
+	eta      time.Time // time the job is due
+	priority int
+	key      time.Time // order in the heap, the ETA while delayed and the rank while ready
+	deadline time.Time // time the job is requeued if it is in flight
+	expires  time.Time // time the job is dropped, zero if never
+	ready    bool
+	inFlight bool
+	index    int // index in the heap
+}
+
+type memoryQueue struct {
+	delayed  memoryHeap
+	ready    memoryHeap
+	inFlight map[string]*memoryJob
+}
+
+// NewMemoryBroker creates an in-memory broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		VisibilityTimeout: DefaultVisibilityTimeout,
+		PriorityAging:     DefaultPriorityAging,
+		jobs:              make(map[string]*memoryJob),
+		queues:            make(map[string]*memoryQueue),
+		wake:              make(chan struct{}),
+	}
+}
+
+// Push adds a job to the delayed heap of the queue
+//
+// With a TTL, the job is dropped once its ETA plus TTL passes. MaxLen counts the
+// pending jobs of the queue, and Replicate and Async are ignored.
+func (b *MemoryBroker) Push(queueName string, data string, delay time.Duration, options *PushOptions) (id string, err error) {
+	id, err = newJobID("M")
+	if err != nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	q := b.queue(queueName)
+	if options != nil && options.MaxLen > 0 && q.delayed.Len()+q.ready.Len() >= options.MaxLen {
+		id = ""
+		err = ErrQueueFull
+		return
+	}
+	job := &memoryJob{
+		message: &Message{
+			ID:        id,
+			QueueName: queueName,
+			Data:      data,
+		},
+		eta: time.Now().Add(delay),
+	}
+	if options != nil {
+		job.priority = options.Priority
+		if options.TTL > 0 {
+			job.expires = job.eta.Add(options.TTL)
+		}
+	}
+	b.jobs[id] = job
+	b.delay(q, job)
+	b.signal()
+	return
+}
+
+// Fetch gets jobs that are due for processing, marking them as in flight
+func (b *MemoryBroker) Fetch(queueName string, n int, timeout time.Duration) (messages []*Message, err error) {
+	messages = make([]*Message, 0)
+	until := time.Now().Add(timeout)
+	for {
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		q := b.queue(queueName)
+		// Requeue in-flight jobs past their deadline
+		for _, job := range q.inFlight {
+			if !now.Before(job.deadline) {
+				b.requeue(q, job, now)
+			}
+		}
+		// Move due jobs to the ready heap
+		for q.delayed.Len() > 0 && !now.Before(q.delayed[0].eta) {
+			job := heap.Pop(&q.delayed).(*memoryJob)
+			b.ready(q, job, job.eta)
+		}
+		// Take the jobs of the best rank off the ready heap
+		for len(messages) < n && q.ready.Len() > 0 {
+			job := heap.Pop(&q.ready).(*memoryJob)
+			job.ready = false
+			if job.expired(now) {
+				delete(b.jobs, job.message.ID)
+				continue
+			}
+			job.inFlight = true
+			job.deadline = now.Add(b.VisibilityTimeout)
+			q.inFlight[job.message.ID] = job
+			messages = append(messages, job.message)
+		}
+		if len(messages) > 0 || !now.Before(until) {
+			b.mutex.Unlock()
+			return
+		}
+		// Wait until the next job is due, something is pushed, or the timeout passes
+		wait := until.Sub(now)
+		if q.delayed.Len() > 0 && q.delayed[0].eta.Sub(now) < wait {
+			wait = q.delayed[0].eta.Sub(now)
+		}
+		for _, job := range q.inFlight {
+			if job.deadline.Sub(now) < wait {
+				wait = job.deadline.Sub(now)
+			}
+		}
+		wake := b.wake
+		b.mutex.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Ack removes an in-flight job
+func (b *MemoryBroker) Ack(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, exists := b.jobs[id]
+	if !exists || !job.inFlight {
+		return nil
+	}
+	delete(b.queue(job.message.QueueName).inFlight, id)
+	delete(b.jobs, id)
+	return nil
+}
+
+// Nack gives an in-flight job back to the heap
+func (b *MemoryBroker) Nack(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, exists := b.jobs[id]
+	if !exists || !job.inFlight {
+		return nil
+	}
+	b.requeue(b.queue(job.message.QueueName), job, time.Now())
+	b.signal()
+	return nil
+}
+
+// Reschedule moves a job that is not in flight back to the delayed heap, at its new ETA
+func (b *MemoryBroker) Reschedule(id string, data string, delay time.Duration) (ok bool, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, exists := b.jobs[id]
+	if !exists || job.inFlight {
+		return
+	}
+	// Replace the message, as the old one may still be read elsewhere
+	message := *job.message
+	message.Data = data
+	job.message = &message
+	eta := time.Now().Add(delay)
+	// Keep the TTL counting from the ETA
+	if !job.expires.IsZero() {
+		job.expires = eta.Add(job.expires.Sub(job.eta))
+	}
+	q := b.queue(message.QueueName)
+	b.unqueue(q, job)
+	job.eta = eta
+	b.delay(q, job)
+	b.signal()
+	ok = true
+	return
+}
+
+// Get gets a job using the id
+func (b *MemoryBroker) Get(id string) (*Message, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, exists := b.jobs[id]
+	if !exists || job.expired(time.Now()) {
+		return nil, nil
+	}
+	return job.message, nil
+}
+
+// Delete removes a job wherever it is
+func (b *MemoryBroker) Delete(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	job, exists := b.jobs[id]
+	if !exists {
+		return nil
+	}
+	q := b.queue(job.message.QueueName)
+	if job.inFlight {
+		delete(q.inFlight, id)
+	} else {
+		b.unqueue(q, job)
+	}
+	delete(b.jobs, id)
+	return nil
+}
+
+// Close wakes up and stops all pending fetches
+func (b *MemoryBroker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.signal()
+}
+
+// Private functions
+
+func (b *MemoryBroker) queue(queueName string) *memoryQueue {
+	q, exists := b.queues[queueName]
+	if !exists {
+		q = &memoryQueue{
+			delayed:  make(memoryHeap, 0),
+			ready:    make(memoryHeap, 0),
+			inFlight: make(map[string]*memoryJob),
+		}
+		b.queues[queueName] = q
+	}
+	return q
+}
+
+func (b *MemoryBroker) requeue(q *memoryQueue, job *memoryJob, now time.Time) {
+	delete(q.inFlight, job.message.ID)
+	job.inFlight = false
+	b.ready(q, job, now)
+}
+
+func (b *MemoryBroker) delay(q *memoryQueue, job *memoryJob) {
+	job.key = job.eta
+	heap.Push(&q.delayed, job)
+}
+
+// ready moves a job to the ready heap, ranked from the time it became ready
+func (b *MemoryBroker) ready(q *memoryQueue, job *memoryJob, since time.Time) {
+	job.ready = true
+	job.key = rank(since, job.priority, b.PriorityAging)
+	heap.Push(&q.ready, job)
+}
+
+// unqueue takes a job that is not in flight off its heap
+func (b *MemoryBroker) unqueue(q *memoryQueue, job *memoryJob) {
+	if job.ready {
+		heap.Remove(&q.ready, job.index)
+		job.ready = false
+	} else {
+		heap.Remove(&q.delayed, job.index)
+	}
+}
+
+func (job *memoryJob) expired(now time.Time) bool {
+	return !job.expires.IsZero() && !now.Before(job.expires)
+}
+
+func (b *MemoryBroker) signal() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// memoryHeap is a heap of jobs ordered by key
+type memoryHeap []*memoryJob
+
+func (h memoryHeap) Len() int           { return len(h) }
+func (h memoryHeap) Less(i, j int) bool { return h[i].key.Before(h[j].key) }
+func (h memoryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *memoryHeap) Push(x interface{}) {
+	job := x.(*memoryJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *memoryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return job
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testQueue = "tq"
+
+func TestMemoryOrder(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	now := time.Now()
+	late, err := AddJob(broker, testQueue, "late", now.Add(200*time.Millisecond), nil)
+	assert.Empty(err)
+	early, err := AddJob(broker, testQueue, "early", now.Add(100*time.Millisecond), nil)
+	assert.Empty(err)
+	// Nothing is due yet
+	messages, err := broker.Fetch(testQueue, 2, 10*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+	// Jobs come out in order of ETA
+	jobs, err := FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(early.ID, jobs[0].ID)
+	assert.False(time.Now().Before(early.ETA))
+	jobs, err = FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(late.ID, jobs[0].ID)
+}
+
+func TestMemoryAckNack(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	job, err := AddJob(broker, testQueue, "ack nack", time.Now(), nil)
+	assert.Empty(err)
+	jobs, err := FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	// A nacked job is delivered again
+	assert.Empty(NackJob(broker, job.ID))
+	jobs, err = FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(job.ID, jobs[0].ID)
+	// An acked job is gone
+	assert.Empty(AckJob(broker, job.ID))
+	_job, err := GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+}
+
+func TestMemoryVisibilityTimeout(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	broker.VisibilityTimeout = 100 * time.Millisecond
+	job, err := AddJob(broker, testQueue, "visibility", time.Now(), nil)
+	assert.Empty(err)
+	messages, err := broker.Fetch(testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(messages, 1)
+	// The job is requeued once in flight for too long
+	messages, err = broker.Fetch(testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(messages, 1)
+	assert.Equal(job.ID, messages[0].ID)
+}
+
+func TestMemoryRemove(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	job, err := AddJob(broker, testQueue, "remove", time.Now(), nil)
+	assert.Empty(err)
+	assert.Empty(RemoveJob(broker, job.ID))
+	_job, err := GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	messages, err := broker.Fetch(testQueue, 1, 10*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+}
+
+func TestMemoryAddOptions(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	// Invalid options are refused
+	_, err := AddJob(broker, testQueue, "invalid", time.Now(), &AddOptions{PushOptions: PushOptions{TTL: -time.Second}})
+	assert.Equal(ErrInvalidOptions, err)
+	// The options are carried with the job
+	options := &AddOptions{
+		PushOptions: PushOptions{MaxLen: 1, Priority: 3},
+		Headers:     map[string]string{"trace": "abc"},
+		Tags:        []string{"customer:1"},
+		Timeout:     time.Minute,
+	}
+	job, err := AddJob(broker, testQueue, "options", time.Now(), options)
+	assert.Empty(err)
+	_job, err := GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Equal(3, _job.Push.Priority)
+	assert.Equal("abc", _job.Headers["trace"])
+	assert.Equal([]string{"customer:1"}, _job.Tags)
+	assert.Equal(time.Minute, _job.Timeout)
+	assert.Equal(1, _job.Push.MaxLen)
+	// The queue refuses jobs past its maximum length
+	_, err = AddJob(broker, testQueue, "full", time.Now(), options)
+	assert.Equal(ErrQueueFull, err)
+	// Jobs are dropped once past their TTL
+	ttl := &AddOptions{PushOptions: PushOptions{TTL: 50 * time.Millisecond}}
+	job, err = AddJob(broker, "tqttl", "ttl", time.Now(), ttl)
+	assert.Empty(err)
+	time.Sleep(100 * time.Millisecond)
+	_job, err = GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	messages, err := broker.Fetch("tqttl", 1, 10*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+}
+
+func TestMemoryPriority(t *testing.T) {
+	assert := assert.New(t)
+	broker := NewMemoryBroker()
+	defer broker.Close()
+	broker.PriorityAging = 100 * time.Millisecond
+	urgent := &AddOptions{PushOptions: PushOptions{Priority: 2}}
+	// Jobs of higher priority go first
+	bulk, err := AddJob(broker, testQueue, "bulk", time.Now(), nil)
+	assert.Empty(err)
+	job, err := AddJob(broker, testQueue, "urgent", time.Now(), urgent)
+	assert.Empty(err)
+	jobs, err := FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(job.ID, jobs[0].ID)
+	// Jobs of lower priority are not passed over once they waited long enough
+	time.Sleep(250 * time.Millisecond)
+	_, err = AddJob(broker, testQueue, "urgent", time.Now(), urgent)
+	assert.Empty(err)
+	jobs, err = FetchJobs(broker, testQueue, 1)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(bulk.ID, jobs[0].ID)
+}
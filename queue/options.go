@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidOptions is the error for options that cannot be applied to a job
+	ErrInvalidOptions = errors.New("Queue Error: invalid job options!")
+	// ErrQueueFull is the error for a job refused because its queue is at its maximum length
+	ErrQueueFull = errors.New("Queue Error: queue is full!")
+)
+
+// PushOptions is the options of a job that are handed to the broker
+//
+// They are kept with the job, so they apply every time it is pushed, e.g. for a
+// retry. Priority is only honored by the redis and memory brokers, and is ignored
+// by disque, which delivers in its own order; Replicate and Async only apply to disque.
+type PushOptions struct {
+	Priority  int           `json:",omitempty"` // priority of the job within its queue, higher first; redis and memory brokers only
+	TTL       time.Duration `json:",omitempty"` // time the job is kept past its ETA before it is dropped; 0 for the broker's default
+	MaxLen    int           `json:",omitempty"` // refuse the job if its queue already holds this many pending jobs; 0 for no limit
+	Replicate int           `json:",omitempty"` // number of nodes the job is replicated to; 0 for the broker's default
+	Async     bool          `json:",omitempty"` // return before the job is replicated
+}
+
+// AddOptions is the options for adding a job
+//
+// The deduplication options need the bookkeeping of a catapult, and only apply to
+// jobs added through it.
+type AddOptions struct {
+	PushOptions
+	Retry       *RetryPolicy      // retry policy of the job, overriding the one of the queue
+	Timeout     time.Duration     // time the job may run before it fails, overriding the timeout of the queue; 0 for the queue's
+	Headers     map[string]string // custom headers carried with the job
+	Tags        []string          // custom tags the job can be found by, e.g. the id of a customer
+	DedupKey    string            // key identifying duplicates of the job within its queue
+	DedupWindow time.Duration     // time duplicates are refused for; 0 for as long as the job is pending
+}
+
+// Validate checks that the options can be applied to a job
+func (o *AddOptions) Validate() error {
+	if o.TTL < 0 || o.MaxLen < 0 || o.Replicate < 0 || o.DedupWindow < 0 || o.Timeout < 0 {
+		return ErrInvalidOptions
+	}
+	if o.Retry != nil && (o.Retry.MaxAttempts < 0 || o.Retry.Delay < 0 || o.Retry.MaxDelay < 0) {
+		return ErrInvalidOptions
+	}
+	for key := range o.Headers {
+		if key == "" {
+			return ErrInvalidOptions
+		}
+	}
+	for _, tag := range o.Tags {
+		if tag == "" {
+			return ErrInvalidOptions
+		}
+	}
+	return nil
+}
+
+// Apply sets the options on a constructed job
+func (o *AddOptions) Apply(job *Job) {
+	job.Retry = o.Retry
+	job.Timeout = o.Timeout
+	job.Headers = o.Headers
+	job.Tags = o.Tags
+	if o.DedupKey != "" && o.DedupWindow == 0 {
+		job.UniqueKey = o.DedupKey
+	}
+	if o.PushOptions != (PushOptions{}) {
+		push := o.PushOptions
+		job.Push = &push
+	}
+}
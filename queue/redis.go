@@ -0,0 +1,367 @@
+package queue
+
+import (
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// DefaultVisibilityTimeout is the default time a fetched job stays in flight before it is requeued
+	DefaultVisibilityTimeout = 5 * time.Minute
+	// DefaultPollInterval is the default interval between polls while waiting for jobs
+	DefaultPollInterval = 100 * time.Millisecond
+	// DefaultRedisBrokerPrefix is the default prefix of the redis broker keys
+	DefaultRedisBrokerPrefix = "ctpb:"
+	// DefaultPriorityAging is the default wait that makes up for one level of priority
+	DefaultPriorityAging = time.Minute
+)
+
+// RedisBroker is a broker implementing delayed jobs on redis
+//
+// Each job is stored in a hash, with its priority in a hash per queue, and its id
+// moves between three sorted sets per queue:
+// delayed jobs keyed by ETA, jobs ready for fetching keyed by rank, and in-flight
+// jobs keyed by the deadline of their visibility timeout. Due jobs are promoted to
+// the ready set, and in-flight jobs that are neither acked nor nacked before the
+// deadline are requeued, so delivery is at least once.
+//
+// All keys of a queue, its jobs included, share the hash tag of the queue, so that
+// they land in the same slot of a redis cluster. The ids of the jobs carry the name
+// of their queue for that, and the scripts are given all the keys they touch.
+type RedisBroker struct {
+	Client            *redis.Pool   // the redis client
+	Prefix            string        // prefix of the keys
+	VisibilityTimeout time.Duration // time a fetched job stays in flight before it is requeued
+	PollInterval      time.Duration // interval between polls while waiting for jobs
+	PriorityAging     time.Duration // wait that makes up for one level of priority
+
+	owned bool // whether the client is owned by and closed with the broker
+}
+
+// NewRedisBroker creates a broker on a redis pool
+func NewRedisBroker(client *redis.Pool, owned bool) *RedisBroker {
+	return &RedisBroker{
+		Client:            client,
+		Prefix:            DefaultRedisBrokerPrefix,
+		VisibilityTimeout: DefaultVisibilityTimeout,
+		PollInterval:      DefaultPollInterval,
+		PriorityAging:     DefaultPriorityAging,
+		owned:             owned,
+	}
+}
+
+// Push adds a job to the delayed set, scored by its ETA
+//
+// With a TTL, the hash of the job expires at its ETA plus TTL, and the job is
+// dropped when it comes up for fetching. MaxLen counts the delayed and ready jobs
+// of the queue, and Replicate and Async are ignored.
+func (b *RedisBroker) Push(queueName string, data string, delay time.Duration, options *PushOptions) (id string, err error) {
+	id, err = newJobID("R")
+	if err != nil {
+		return
+	}
+	id += redisQueueSeparator + queueName
+	eta := toMillis(time.Now().Add(delay))
+	var maxLen, priority int
+	var ttl int64
+	if options != nil {
+		maxLen = options.MaxLen
+		priority = options.Priority
+		if options.TTL > 0 {
+			ttl = int64((delay + options.TTL) / time.Millisecond)
+		}
+	}
+	conn := b.Client.Get()
+	defer conn.Close()
+	pushed, err := redis.Int(redisPushJob.Do(conn,
+		b.jobKey(queueName, id),
+		b.queueKey(queueName, "delayed"),
+		b.queueKey(queueName, "ready"),
+		b.queueKey(queueName, "priority"),
+		id, queueName, data, eta, maxLen, ttl, priority,
+	))
+	if err != nil {
+		return
+	}
+	if pushed == 0 {
+		id = ""
+		err = ErrQueueFull
+	}
+	return
+}
+
+// Fetch gets jobs that are due for processing, marking them as in flight
+func (b *RedisBroker) Fetch(queueName string, n int, timeout time.Duration) (messages []*Message, err error) {
+	messages = make([]*Message, 0)
+	until := time.Now().Add(timeout)
+	conn := b.Client.Get()
+	defer conn.Close()
+	for {
+		now := time.Now()
+		deadline := toMillis(now.Add(b.VisibilityTimeout))
+		var ids []string
+		ids, err = redis.Strings(redisFetchJobs.Do(conn,
+			b.queueKey(queueName, "delayed"),
+			b.queueKey(queueName, "ready"),
+			b.queueKey(queueName, "inflight"),
+			b.queueKey(queueName, "priority"),
+			toMillis(now), n, deadline, b.agingMillis(),
+		))
+		if err != nil {
+			return
+		}
+		for _, id := range ids {
+			var data string
+			data, err = redis.String(conn.Do("HGET", b.jobKey(queueName, id), "data"))
+			if err == redis.ErrNil {
+				// The job is removed or expired while in flight, drop it
+				_, _ = conn.Do("ZREM", b.queueKey(queueName, "inflight"), id)
+				_, _ = conn.Do("HDEL", b.queueKey(queueName, "priority"), id)
+				continue
+			}
+			if err != nil {
+				return
+			}
+			messages = append(messages, &Message{
+				ID:        id,
+				QueueName: queueName,
+				Data:      data,
+			})
+		}
+		err = nil
+		if len(messages) > 0 || !now.Before(until) {
+			return
+		}
+		// Wait before polling again
+		time.Sleep(b.PollInterval)
+	}
+}
+
+// Ack removes an in-flight job
+func (b *RedisBroker) Ack(id string) (err error) {
+	queueName, ok := queueOfID(id)
+	if !ok {
+		return
+	}
+	conn := b.Client.Get()
+	defer conn.Close()
+	_, err = redisAckJob.Do(conn,
+		b.jobKey(queueName, id),
+		b.queueKey(queueName, "inflight"),
+		b.queueKey(queueName, "priority"),
+		id,
+	)
+	return
+}
+
+// Nack moves an in-flight job back to the ready set
+func (b *RedisBroker) Nack(id string) (err error) {
+	queueName, ok := queueOfID(id)
+	if !ok {
+		return
+	}
+	conn := b.Client.Get()
+	defer conn.Close()
+	_, err = redisNackJob.Do(conn,
+		b.jobKey(queueName, id),
+		b.queueKey(queueName, "inflight"),
+		b.queueKey(queueName, "ready"),
+		b.queueKey(queueName, "priority"),
+		id, toMillis(time.Now()), b.agingMillis(),
+	)
+	return
+}
+
+// Get gets a job using the id
+func (b *RedisBroker) Get(id string) (message *Message, err error) {
+	queueName, ok := queueOfID(id)
+	if !ok {
+		return
+	}
+	conn := b.Client.Get()
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("HMGET", b.jobKey(queueName, id), "queue", "data"))
+	if err != nil {
+		return
+	}
+	if values[0] == "" {
+		return
+	}
+	message = &Message{
+		ID:        id,
+		QueueName: values[0],
+		Data:      values[1],
+	}
+	return
+}
+
+// Reschedule moves a job that is not in flight back to the delayed set, scored by its new ETA
+func (b *RedisBroker) Reschedule(id string, data string, delay time.Duration) (ok bool, err error) {
+	queueName, known := queueOfID(id)
+	if !known {
+		return
+	}
+	eta := toMillis(time.Now().Add(delay))
+	conn := b.Client.Get()
+	defer conn.Close()
+	moved, err := redis.Int(redisRescheduleJob.Do(conn,
+		b.jobKey(queueName, id),
+		b.queueKey(queueName, "inflight"),
+		b.queueKey(queueName, "delayed"),
+		b.queueKey(queueName, "ready"),
+		id, data, eta, toMillis(time.Now()),
+	))
+	ok = moved == 1
+	return
+}
+
+// Delete removes a job wherever it is
+func (b *RedisBroker) Delete(id string) (err error) {
+	queueName, ok := queueOfID(id)
+	if !ok {
+		return
+	}
+	conn := b.Client.Get()
+	defer conn.Close()
+	_, err = redisDeleteJob.Do(conn,
+		b.jobKey(queueName, id),
+		b.queueKey(queueName, "delayed"),
+		b.queueKey(queueName, "inflight"),
+		b.queueKey(queueName, "ready"),
+		b.queueKey(queueName, "priority"),
+		id,
+	)
+	return
+}
+
+// Close shuts down the redis pool if it is owned by the broker
+func (b *RedisBroker) Close() {
+	if b.owned {
+		b.Client.Close()
+	}
+}
+
+// Private functions
+
+// redisQueueSeparator separates the name of the queue from the rest of a job id
+const redisQueueSeparator = "@"
+
+// queueOfID gets the name of the queue of a job from its id
+func queueOfID(id string) (queueName string, ok bool) {
+	i := strings.Index(id, redisQueueSeparator)
+	if i < 0 {
+		return
+	}
+	return id[i+len(redisQueueSeparator):], true
+}
+
+func (b *RedisBroker) jobKey(queueName string, id string) string {
+	return b.Prefix + "{" + queueName + "}:job:" + id
+}
+
+func (b *RedisBroker) queueKey(queueName string, set string) string {
+	return b.Prefix + "{" + queueName + "}:" + set
+}
+
+func (b *RedisBroker) agingMillis() int64 {
+	return int64(b.PriorityAging / time.Millisecond)
+}
+
+// Redis script for pushing a job
+var redisPushJobScript = `
+  local maxlen = tonumber(ARGV[5])
+  if maxlen > 0 and redis.call("ZCARD", KEYS[2]) + redis.call("ZCARD", KEYS[3]) >= maxlen then
+    return 0
+  end
+  redis.call("HMSET", KEYS[1], "queue", ARGV[2], "data", ARGV[3])
+  if tonumber(ARGV[6]) > 0 then
+    redis.call("PEXPIRE", KEYS[1], ARGV[6])
+  end
+  if tonumber(ARGV[7]) ~= 0 then
+    redis.call("HSET", KEYS[4], ARGV[1], ARGV[7])
+  end
+  redis.call("ZADD", KEYS[2], ARGV[4], ARGV[1])
+  return 1
+`
+var redisPushJob = redis.NewScript(4, redisPushJobScript)
+
+// Redis script for promoting due jobs, requeueing expired in-flight jobs and fetching
+// the ready jobs of the best rank
+var redisFetchJobsScript = `
+  local function rank(id, since)
+    local priority = tonumber(redis.call("HGET", KEYS[4], id) or 0)
+    return since - priority * tonumber(ARGV[4])
+  end
+  local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "WITHSCORES")
+  for i = 1, #due, 2 do
+    redis.call("ZREM", KEYS[1], due[i])
+    redis.call("ZADD", KEYS[2], rank(due[i], tonumber(due[i + 1])), due[i])
+  end
+  local expired = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])
+  for _, id in ipairs(expired) do
+    redis.call("ZREM", KEYS[3], id)
+    redis.call("ZADD", KEYS[2], rank(id, tonumber(ARGV[1])), id)
+  end
+  local ids = redis.call("ZRANGE", KEYS[2], 0, tonumber(ARGV[2]) - 1)
+  for _, id in ipairs(ids) do
+    redis.call("ZREM", KEYS[2], id)
+    redis.call("ZADD", KEYS[3], ARGV[3], id)
+  end
+  return ids
+`
+var redisFetchJobs = redis.NewScript(4, redisFetchJobsScript)
+
+// Redis script for acking a job
+var redisAckJobScript = `
+  redis.call("ZREM", KEYS[2], ARGV[1])
+  redis.call("HDEL", KEYS[3], ARGV[1])
+  return redis.call("DEL", KEYS[1])
+`
+var redisAckJob = redis.NewScript(3, redisAckJobScript)
+
+// Redis script for nacking a job
+var redisNackJobScript = `
+  if redis.call("EXISTS", KEYS[1]) == 0 then
+    return 0
+  end
+  if redis.call("ZREM", KEYS[2], ARGV[1]) == 1 then
+    local priority = tonumber(redis.call("HGET", KEYS[4], ARGV[1]) or 0)
+    local rank = tonumber(ARGV[2]) - priority * tonumber(ARGV[3])
+    return redis.call("ZADD", KEYS[3], rank, ARGV[1])
+  end
+  return 0
+`
+var redisNackJob = redis.NewScript(4, redisNackJobScript)
+
+// Redis script for rescheduling a job
+var redisRescheduleJobScript = `
+  if redis.call("EXISTS", KEYS[1]) == 0 then
+    return 0
+  end
+  if redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+    return 0
+  end
+  -- Keep the TTL counting from the ETA
+  local pttl = redis.call("PTTL", KEYS[1])
+  if pttl > 0 then
+    local eta = tonumber(redis.call("ZSCORE", KEYS[3], ARGV[1]) or ARGV[4])
+    redis.call("PEXPIRE", KEYS[1], math.max(1, pttl + tonumber(ARGV[3]) - eta))
+  end
+  redis.call("ZREM", KEYS[4], ARGV[1])
+  redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+  redis.call("HSET", KEYS[1], "data", ARGV[2])
+  return 1
+`
+var redisRescheduleJob = redis.NewScript(4, redisRescheduleJobScript)
+
+// Redis script for deleting a job
+var redisDeleteJobScript = `
+  redis.call("ZREM", KEYS[2], ARGV[1])
+  redis.call("ZREM", KEYS[3], ARGV[1])
+  redis.call("ZREM", KEYS[4], ARGV[1])
+  redis.call("HDEL", KEYS[5], ARGV[1])
+  return redis.call("DEL", KEYS[1])
+`
+var redisDeleteJob = redis.NewScript(5, redisDeleteJobScript)
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+var redisTestPrefix = "tq:b:"
+
+func getClient(t *testing.T) *redis.Pool {
+	client := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			// Construct connection
+			conn, err := redis.Dial("tcp", "127.0.0.1:6379")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Do("SELECT", "7"); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	// Skip redis tests if redis is not available
+	conn := client.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		client.Close()
+		t.Skip("redis is not available: ", err)
+	}
+	return client
+}
+
+// getBroker creates a redis broker on keys cleared of previous runs
+func getBroker(t *testing.T) *RedisBroker {
+	client := getClient(t)
+	conn := client.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", redisTestPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		_, _ = conn.Do("DEL", key)
+	}
+	broker := NewRedisBroker(client, true)
+	broker.Prefix = redisTestPrefix
+	broker.PollInterval = 10 * time.Millisecond
+	return broker
+}
+
+func TestRedisOrder(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	now := time.Now()
+	late, err := AddJob(broker, testQueue, "late", now.Add(200*time.Millisecond), nil)
+	assert.Empty(err)
+	early, err := AddJob(broker, testQueue, "early", now.Add(100*time.Millisecond), nil)
+	assert.Empty(err)
+	// Nothing is due yet
+	messages, err := broker.Fetch(testQueue, 2, 10*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+	// Jobs come out in order of ETA
+	jobs, err := FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(early.ID, jobs[0].ID)
+	assert.Equal("early", jobs[0].Body)
+	jobs, err = FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(late.ID, jobs[0].ID)
+}
+
+func TestRedisAckNack(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	job, err := AddJob(broker, testQueue, "ack nack", time.Now(), nil)
+	assert.Empty(err)
+	jobs, err := FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	// A nacked job is delivered again
+	assert.Empty(NackJob(broker, job.ID))
+	jobs, err = FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(job.ID, jobs[0].ID)
+	// An acked job is gone
+	assert.Empty(AckJob(broker, job.ID))
+	_job, err := GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	messages, err := broker.Fetch(testQueue, 1, 50*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+	// Removed jobs are gone wherever they are
+	job, err = AddJob(broker, testQueue, "remove", time.Now(), nil)
+	assert.Empty(err)
+	assert.Empty(RemoveJob(broker, job.ID))
+	_job, err = GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	messages, err = broker.Fetch(testQueue, 1, 50*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+}
+
+func TestRedisVisibilityTimeout(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	broker.VisibilityTimeout = 100 * time.Millisecond
+	job, err := AddJob(broker, testQueue, "visibility", time.Now(), nil)
+	assert.Empty(err)
+	messages, err := broker.Fetch(testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(messages, 1)
+	// The job is requeued once in flight for too long
+	messages, err = broker.Fetch(testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(messages, 1)
+	assert.Equal(job.ID, messages[0].ID)
+}
+
+func TestRedisAddOptions(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	// The queue refuses jobs past its maximum length
+	full := &AddOptions{PushOptions: PushOptions{MaxLen: 1}}
+	_, err := AddJob(broker, testQueue, "first", time.Now(), full)
+	assert.Empty(err)
+	_, err = AddJob(broker, testQueue, "full", time.Now(), full)
+	assert.Equal(ErrQueueFull, err)
+	// Jobs are dropped once past their TTL
+	ttl := &AddOptions{PushOptions: PushOptions{TTL: 50 * time.Millisecond}}
+	job, err := AddJob(broker, "tqttl", "ttl", time.Now(), ttl)
+	assert.Empty(err)
+	time.Sleep(100 * time.Millisecond)
+	_job, err := GetJob(broker, job.ID)
+	assert.Empty(err)
+	assert.Empty(_job)
+	messages, err := broker.Fetch("tqttl", 1, 10*time.Millisecond)
+	assert.Empty(err)
+	assert.Len(messages, 0)
+}
+
+func TestRedisPriority(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	broker.PriorityAging = 100 * time.Millisecond
+	urgent := &AddOptions{PushOptions: PushOptions{Priority: 2}}
+	// Jobs of higher priority go first
+	bulk, err := AddJob(broker, testQueue, "bulk", time.Now(), nil)
+	assert.Empty(err)
+	job, err := AddJob(broker, testQueue, "urgent", time.Now(), urgent)
+	assert.Empty(err)
+	jobs, err := FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(job.ID, jobs[0].ID)
+	// Jobs of lower priority are not passed over once they waited long enough
+	time.Sleep(250 * time.Millisecond)
+	_, err = AddJob(broker, testQueue, "urgent", time.Now(), urgent)
+	assert.Empty(err)
+	jobs, err = FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(bulk.ID, jobs[0].ID)
+	// The priorities of the jobs go with them
+	assert.Empty(AckJob(broker, job.ID))
+	conn := broker.Client.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("HLEN", broker.queueKey(testQueue, "priority")))
+	assert.Empty(err)
+	assert.Equal(1, n)
+}
+
+func TestRedisReschedule(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	job, err := AddJob(broker, testQueue, "reschedule", time.Now().Add(time.Hour), nil)
+	assert.Empty(err)
+	// A pending job is moved in place, with its new data
+	job.ETA = time.Now()
+	job.Body = "rescheduled"
+	ok, err := RescheduleJob(broker, job)
+	assert.Empty(err)
+	assert.True(ok)
+	jobs, err := FetchJobsWithTimeout(broker, testQueue, 1, time.Second)
+	assert.Empty(err)
+	assert.Len(jobs, 1)
+	assert.Equal(job.ID, jobs[0].ID)
+	assert.Equal("rescheduled", jobs[0].Body)
+	// A job in flight is left alone
+	job.ETA = time.Now().Add(time.Hour)
+	ok, err = RescheduleJob(broker, job)
+	assert.Empty(err)
+	assert.False(ok)
+	// So is a job that is gone
+	assert.Empty(AckJob(broker, job.ID))
+	ok, err = RescheduleJob(broker, job)
+	assert.Empty(err)
+	assert.False(ok)
+}
+
+func TestRedisClusterKeys(t *testing.T) {
+	assert := assert.New(t)
+	broker := getBroker(t)
+	defer broker.Close()
+	job, err := AddJob(broker, testQueue, "cluster", time.Now(), nil)
+	assert.Empty(err)
+	_, err = broker.Fetch(testQueue, 1, time.Second)
+	assert.Empty(err)
+	// All keys of the queue share its hash tag, so they land in the same slot
+	conn := broker.Client.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", redisTestPrefix+"*"))
+	assert.Empty(err)
+	assert.NotEmpty(keys)
+	for _, key := range keys {
+		assert.True(strings.HasPrefix(key, redisTestPrefix+"{"+testQueue+"}:"), key)
+	}
+	queueName, ok := queueOfID(job.ID)
+	assert.True(ok)
+	assert.Equal(testQueue, queueName)
+	// Ids of another broker are unknown
+	_job, err := GetJob(broker, "D-unknown")
+	assert.Empty(err)
+	assert.Empty(_job)
+}
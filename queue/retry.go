@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy is the strategy for spacing out the retries of a job
+type BackoffStrategy string
+
+const (
+	// BackoffFixed retries after the same delay every time
+	BackoffFixed BackoffStrategy = "fixed"
+	// BackoffExponential doubles the delay after every attempt
+	BackoffExponential BackoffStrategy = "exponential"
+	// BackoffJittered doubles the delay after every attempt, picking a random delay up to it
+	BackoffJittered BackoffStrategy = "jittered"
+)
+
+// RetryPolicy is the policy for retrying failed jobs
+type RetryPolicy struct {
+	MaxAttempts int             // maximum number of attempts, including the first one; 0 for no limit
+	Backoff     BackoffStrategy // strategy for spacing out the retries, fixed by default
+	Delay       time.Duration   // delay before the first retry
+	MaxDelay    time.Duration   // upper bound of the delay; 0 for no bound
+}
+
+// JobError is the error of a failed attempt of a job
+type JobError struct {
+	Attempt int
+	Error   string
+	At      time.Time
+}
+
+// Exhausted tells whether a job is out of attempts after failing the attempt
+func (p *RetryPolicy) Exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// NextDelay calculates the delay before retrying a job that failed the attempt
+func (p *RetryPolicy) NextDelay(attempt int) time.Duration {
+	delay := p.Delay
+	if p.Backoff == BackoffExponential || p.Backoff == BackoffJittered {
+		for i := 1; i < attempt; i++ {
+			if delay > math.MaxInt64/2 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+				break
+			}
+			delay *= 2
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Backoff == BackoffJittered && delay > 0 {
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	fixed := &RetryPolicy{
+		MaxAttempts: 3,
+		Delay:       time.Second,
+	}
+	assert.Equal(time.Second, fixed.NextDelay(1))
+	assert.Equal(time.Second, fixed.NextDelay(5))
+	assert.False(fixed.Exhausted(2))
+	assert.True(fixed.Exhausted(3))
+	exponential := &RetryPolicy{
+		Backoff:  BackoffExponential,
+		Delay:    time.Second,
+		MaxDelay: 5 * time.Second,
+	}
+	assert.Equal(time.Second, exponential.NextDelay(1))
+	assert.Equal(2*time.Second, exponential.NextDelay(2))
+	assert.Equal(4*time.Second, exponential.NextDelay(3))
+	assert.Equal(5*time.Second, exponential.NextDelay(4))
+	assert.Equal(5*time.Second, exponential.NextDelay(100))
+	assert.False(exponential.Exhausted(100))
+	jittered := &RetryPolicy{
+		Backoff: BackoffJittered,
+		Delay:   time.Second,
+	}
+	for i := 0; i < 10; i++ {
+		delay := jittered.NextDelay(3)
+		assert.True(delay >= 0)
+		assert.True(delay <= 4*time.Second)
+	}
+}
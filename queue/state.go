@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"time"
+)
+
+// State is the state of a job in its lifecycle
+type State string
+
+const (
+	// StateScheduled is the state of a job waiting for its ETA
+	StateScheduled State = "scheduled"
+	// StateQueued is the state of a job past its ETA, waiting for a worker
+	StateQueued State = "queued"
+	// StateActive is the state of a job being processed
+	StateActive State = "active"
+	// StateCompleted is the state of a job processed successfully
+	StateCompleted State = "completed"
+	// StateFailed is the state of a job that failed its last attempt and waits to be retried
+	StateFailed State = "failed"
+	// StateDead is the state of a job out of attempts
+	StateDead State = "dead"
+)
+
+// States is all the states of a job, in the order of its lifecycle
+var States = []State{StateScheduled, StateQueued, StateActive, StateCompleted, StateFailed, StateDead}
+
+// Transition is a change of the state of a job
+type Transition struct {
+	State State
+	At    time.Time
+}
+
+// transitions is the states a job in a state can move to
+var transitions = map[State][]State{
+	StateScheduled: {StateScheduled, StateActive},
+	StateQueued:    {StateScheduled, StateActive},
+	StateActive:    {StateScheduled, StateCompleted, StateFailed, StateDead},
+	StateFailed:    {StateScheduled, StateActive, StateDead},
+	StateDead:      {StateScheduled},
+	StateCompleted: {},
+}
+
+// CanTransition tells whether a job in the state can move to the next state
+//
+// A job without a state, e.g. one added before states were kept, can move to any.
+func (s State) CanTransition(next State) bool {
+	if s == "" {
+		return true
+	}
+	for _, state := range transitions[s] {
+		if state == next {
+			return true
+		}
+	}
+	return false
+}
+
+// At tells the state at the time of a job in the state, due at the ETA
+//
+// Jobs are only ever moved to the scheduled state; they are queued once they are due.
+func (s State) At(ETA time.Time, now time.Time) State {
+	if s == StateScheduled && !ETA.After(now) {
+		return StateQueued
+	}
+	return s
+}
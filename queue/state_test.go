@@ -0,0 +1,27 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStates(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(StateScheduled.CanTransition(StateActive))
+	assert.True(StateActive.CanTransition(StateCompleted))
+	assert.True(StateActive.CanTransition(StateFailed))
+	assert.True(StateFailed.CanTransition(StateActive))
+	assert.True(StateDead.CanTransition(StateScheduled))
+	assert.False(StateCompleted.CanTransition(StateActive))
+	assert.False(StateScheduled.CanTransition(StateCompleted))
+	assert.False(StateDead.CanTransition(StateActive))
+	// Jobs without a state can move to any
+	assert.True(State("").CanTransition(StateCompleted))
+	// Scheduled jobs are queued once they are due
+	now := time.Now()
+	assert.Equal(StateScheduled, StateScheduled.At(now.Add(time.Second), now))
+	assert.Equal(StateQueued, StateScheduled.At(now, now))
+	assert.Equal(StateActive, StateActive.At(now.Add(-time.Second), now))
+}
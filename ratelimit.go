@@ -0,0 +1,114 @@
+package catapult
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// ErrInvalidRateLimit is the error for a rate limit without a positive limit and period
+var ErrInvalidRateLimit = errors.New("Catapult Error: rate limit must have a positive limit and period!")
+
+// MaxRateLimitWait is the longest a worker holds back a job over the rate limit;
+// jobs that would wait longer are delayed to a later period instead
+var MaxRateLimitWait = time.Second
+
+// RateLimit is a limit on the number of jobs of a queue started per period, across all processes
+type RateLimit struct {
+	Limit  int                     // maximum number of jobs started per period
+	Period time.Duration           // length of the period
+	Key    func(*queue.Job) string // key of the jobs limited separately, e.g. read from the body; nil to limit the queue as a whole
+}
+
+// SetRateLimit sets the rate limit of a queue, or removes it if the limit is nil
+//
+// The jobs started are counted in redis per period, so the limit holds across all
+// processes. A job over the limit is held back until the next period if that is
+// close, and delayed to a random point of the next period otherwise.
+func (c *Catapult) SetRateLimit(queueName string, limit *RateLimit) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limit == nil {
+		delete(c.rateLimits, queueName)
+		return nil
+	}
+	if limit.Limit <= 0 || limit.Period <= 0 {
+		return ErrInvalidRateLimit
+	}
+	c.rateLimits[queueName] = limit
+	return nil
+}
+
+// Private functions
+
+// admit counts a job against the rate limit of its queue, returning whether it may
+// start now; jobs that may not are given back to the broker
+func (c *Catapult) admit(parent context.Context, job *queue.Job) bool {
+	limit := c.getRateLimit(job.QueueName)
+	if limit == nil {
+		return true
+	}
+	key := ""
+	if limit.Key != nil {
+		key = limit.Key(job)
+	}
+	for {
+		now := time.Now()
+		window := now.UnixNano() / int64(limit.Period)
+		count, err := c.store.Incr(c.getKeyForRate(job.QueueName, key, window), 2*limit.Period)
+		if err != nil {
+			c.log().Log(logger.LevelError, "rate limit check failed", jobFields(job, logger.F("error", err))...)
+			_ = c.nack(parent, job.MessageID)
+			return false
+		}
+		if count <= limit.Limit {
+			return true
+		}
+		next := time.Unix(0, (window+1)*int64(limit.Period))
+		// Delay the job if the next period is far
+		if next.Sub(now) > MaxRateLimitWait {
+			jitter := time.Duration(rand.Int63n(int64(limit.Period)))
+			c.postpone(parent, job, next.Add(jitter))
+			return false
+		}
+		// Otherwise hold it back until the next period
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+		case <-parent.Done():
+			timer.Stop()
+			_ = c.nack(parent, job.MessageID)
+			return false
+		}
+	}
+}
+
+// postpone moves a job to a later ETA without counting an attempt
+func (c *Catapult) postpone(ctx context.Context, job *queue.Job, ETA time.Time) {
+	next := *job
+	next.ETA = ETA
+	next.UpdatedAt = time.Now()
+	err := c.enqueue(&next)
+	if err != nil {
+		c.log().Log(logger.LevelError, "job postpone failed", jobFields(job, logger.F("error", err))...)
+		_ = c.nack(ctx, job.MessageID)
+		return
+	}
+	c.transition(&next, queue.StateScheduled)
+	_ = c.ack(ctx, job.MessageID)
+}
+
+func (c *Catapult) getRateLimit(queueName string) *RateLimit {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.rateLimits[queueName]
+}
+
+func (c *Catapult) getKeyForRate(queueName string, key string, window int64) string {
+	return "rate:" + queueName + ":" + key + ":" + strconv.FormatInt(window, 10)
+}
@@ -0,0 +1,160 @@
+package catapult
+
+import (
+	"errors"
+	"time"
+
+	"catapult/queue"
+)
+
+var (
+	// ErrJobNotFound is the error for a job that does not exist
+	ErrJobNotFound = errors.New("Catapult Error: job is not found!")
+	// ErrJobNotPending is the error for a job that is already being processed
+	ErrJobNotPending = errors.New("Catapult Error: job is not pending!")
+)
+
+// Reschedule moves a pending job to a new ETA, keeping its id
+//
+// Brokers that can move a job in place do so atomically. For the others, the job
+// is pushed again under a new message, the original message is removed, and the
+// id of the job is pointed at the new message. Jobs moved beyond the staging
+// horizon are staged, and staged jobs are moved on the stage. Either way, the job
+// is locked while it moves, so no worker starts it in the meantime, and a job
+// that is already being processed is not moved.
+func (c *Catapult) Reschedule(id string, ETA time.Time) (job *queue.Job, err error) {
+	// Acquire a lock on the job
+	l := c.newLock(c.prefix+id, false)
+	l.MaxAttempts = 1
+	result, err := l.Get()
+	if err != nil {
+		return
+	}
+	if !result {
+		err = ErrJobNotPending
+		return
+	}
+	defer l.Release()
+	// Record the move once done
+	defer func() {
+		if err == nil && job != nil {
+			c.transition(job, queue.StateScheduled)
+		}
+	}()
+	now := time.Now()
+	// Move a staged job on the stage, or into the broker if it comes within range
+	job, err = c.getStagedJob(id)
+	if err != nil {
+		return
+	}
+	if job != nil {
+		job.ETA = ETA
+		job.UpdatedAt = now
+		err = c.enqueue(job)
+		if err == nil && job.MessageID != "" {
+			err = c.unstage(id)
+		}
+		if err != nil {
+			job = nil
+		}
+		return
+	}
+	// Get the current state of the job
+	job, err = c.Get(id)
+	if err != nil {
+		return
+	}
+	if job == nil {
+		err = ErrJobNotFound
+		return
+	}
+	original := job.MessageID
+	job.ETA = ETA
+	job.UpdatedAt = now
+	// Move the job in place if possible
+	if broker, ok := c.broker.(queue.Rescheduler); ok {
+		var moved bool
+		moved, err = queue.RescheduleJob(broker, job)
+		if err == nil && !moved {
+			err = ErrJobNotPending
+		}
+		if err != nil {
+			job = nil
+			return
+		}
+		if ETA.Sub(now) <= StagingHorizon {
+			return
+		}
+	}
+	// Stage the job if it moves beyond the horizon
+	if ETA.Sub(now) > StagingHorizon {
+		err = c.stage(job)
+		if err != nil {
+			job = nil
+			return
+		}
+		err = queue.RemoveJob(c.broker, original)
+		_ = c.store.Delete(c.getKeyForAlias(id))
+		return
+	}
+	// Otherwise replace the message of the job
+	err = c.enqueue(job)
+	if err != nil {
+		job = nil
+		return
+	}
+	err = queue.RemoveJob(c.broker, original)
+	return
+}
+
+// Private functions
+
+// resolve gets the id of the message currently carrying a job
+func (c *Catapult) resolve(id string) (string, error) {
+	messageID, err := c.store.Get(c.getKeyForAlias(id))
+	if err != nil {
+		return "", err
+	}
+	if messageID == "" {
+		return id, nil
+	}
+	return messageID, nil
+}
+
+// alias points the id of a job at its current message, if it moved to another one
+func (c *Catapult) alias(job *queue.Job) error {
+	if job.ID == job.MessageID {
+		return nil
+	}
+	return c.store.Set(c.getKeyForAlias(job.ID), job.MessageID, 0)
+}
+
+// unalias forgets the message of a job once the job leaves the broker
+func (c *Catapult) unalias(job *queue.Job) {
+	if job.ID != job.MessageID {
+		_ = c.store.Delete(c.getKeyForAlias(job.ID))
+	}
+}
+
+// moved checks whether a fetched message no longer carries its job
+//
+// Only brokers without in-place rescheduling move pending jobs to other messages
+// or to the stage, so the check is skipped for the others.
+func (c *Catapult) moved(job *queue.Job) bool {
+	if _, ok := c.broker.(queue.Rescheduler); ok {
+		return false
+	}
+	messageID, err := c.resolve(job.ID)
+	if err != nil {
+		return false
+	}
+	if messageID != job.MessageID {
+		return true
+	}
+	staged, err := c.getStagedJob(job.ID)
+	return err == nil && staged != nil
+}
+
+func (c *Catapult) getKeyForAlias(id string) string {
+	return "alias:" + id
+}
@@ -0,0 +1,110 @@
+package catapult
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// ErrResultUnavailable is the error for a wait on a result whose notifications stopped
+var ErrResultUnavailable = errors.New("Catapult Error: result notifications are unavailable!")
+
+// ResultTTL is how long the results of the jobs are kept
+var ResultTTL = 24 * time.Hour
+
+// Result is the outcome of a job
+type Result struct {
+	ID         string          // id of the job
+	Value      json.RawMessage `json:",omitempty"` // value returned by the handler, encoded as JSON
+	Error      string          `json:",omitempty"` // error of the last attempt, if the job is dead
+	FinishedAt time.Time       // timestamp at which the job was done or given up on
+}
+
+// Decode decodes the value returned by the handler into v
+func (r *Result) Decode(v interface{}) error {
+	if len(r.Value) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Value, v)
+}
+
+// Result gets the result of a job, or nil if the job is not done yet
+//
+// A result is kept for ResultTTL once the job is processed, or once it runs out of
+// attempts, in which case the error of its last attempt is kept instead.
+func (c *Catapult) Result(id string) (result *Result, err error) {
+	data, err := c.store.Get(c.getKeyForResult(id))
+	if err != nil || data == "" {
+		return
+	}
+	result = &Result{}
+	err = json.Unmarshal([]byte(data), result)
+	return
+}
+
+// Wait waits until a job is done and returns its result, or until ctx is done
+//
+// The waiters are notified through pub/sub when the result is saved.
+func (c *Catapult) Wait(ctx context.Context, id string) (result *Result, err error) {
+	// Subscribe before checking, so that a result saved in between is not missed
+	messages, cancel, err := c.store.Subscribe(c.getKeyForResult(id))
+	if err != nil {
+		return
+	}
+	defer cancel()
+	for {
+		result, err = c.Result(id)
+		if err != nil || result != nil {
+			return
+		}
+		select {
+		case _, open := <-messages:
+			if !open {
+				err = ErrResultUnavailable
+				return
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// Private functions
+
+// saveResult keeps the outcome of a job and notifies the waiters
+func (c *Catapult) saveResult(job *queue.Job, value interface{}, cause error) {
+	result := &Result{
+		ID:         job.ID,
+		FinishedAt: time.Now(),
+	}
+	if cause != nil {
+		result.Error = cause.Error()
+	} else if value != nil {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Value = encoded
+		}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	key := c.getKeyForResult(job.ID)
+	err = c.store.Set(key, string(data), ResultTTL)
+	if err != nil {
+		c.log().Log(logger.LevelError, "job result save failed", jobFields(job, logger.F("error", err))...)
+		return
+	}
+	_ = c.store.Publish(key, job.ID)
+}
+
+func (c *Catapult) getKeyForResult(id string) string {
+	return "result:" + id
+}
@@ -0,0 +1,207 @@
+package catapult
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+// SetRetryPolicy sets the retry policy for the failed jobs of a queue
+//
+// Jobs of a queue without a retry policy are nacked and redelivered when they fail.
+func (c *Catapult) SetRetryPolicy(queueName string, policy *queue.RetryPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if policy == nil {
+		delete(c.retries, queueName)
+		return
+	}
+	c.retries[queueName] = policy
+}
+
+// AddWithRetry adds a job with its own retry policy, overriding the one of the queue
+func (c *Catapult) AddWithRetry(queueName string, body string, ETA time.Time, policy *queue.RetryPolicy) (job *queue.Job, err error) {
+	job, err = c.Add(queueName, body, ETA, &queue.AddOptions{
+		Retry: policy,
+	})
+	return
+}
+
+// DeadJobs lists the jobs of a queue that ran out of attempts, oldest first
+func (c *Catapult) DeadJobs(queueName string, offset int, count int) (jobs []*queue.Job, err error) {
+	jobs = make([]*queue.Job, 0)
+	ids, err := c.store.ZRangeByScore(c.getKeyForDeadQueue(queueName), math.Inf(-1), math.Inf(1), offset, count)
+	if err != nil {
+		return
+	}
+	var job *queue.Job
+	for _, id := range ids {
+		job, err = c.getDeadJob(id)
+		if err != nil {
+			return
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return
+}
+
+// CountDeadJobs counts the jobs of a queue that ran out of attempts
+func (c *Catapult) CountDeadJobs(queueName string) (int, error) {
+	return c.store.ZCount(c.getKeyForDeadQueue(queueName), math.Inf(-1), math.Inf(1))
+}
+
+// Replay moves a dead job back to its queue with a fresh set of attempts
+//
+// The errors of the previous attempts are kept on the job.
+func (c *Catapult) Replay(id string) (job *queue.Job, err error) {
+	job, err = c.getDeadJob(id)
+	if err != nil || job == nil {
+		return
+	}
+	// Claim the dead job so that it is only replayed once
+	removed, err := c.store.ZRem(c.getKeyForDeadQueue(job.QueueName), id)
+	if err != nil || !removed {
+		job = nil
+		return
+	}
+	job.ETA = time.Now()
+	job.UpdatedAt = job.ETA
+	job.Attempt = 1
+	err = c.enqueue(job)
+	if err != nil {
+		// Put it back among the dead
+		_ = c.store.ZAdd(c.getKeyForDeadQueue(job.QueueName), float64(toMillis(time.Now())), id)
+		return
+	}
+	err = c.store.Delete(c.getKeyForDeadJob(id), c.getKeyForResult(id))
+	if err != nil {
+		return
+	}
+	// Leave the record alone if a worker already picked the job up
+	c.transition(job, queue.StateScheduled, queue.StateDead, stateNone)
+	return
+}
+
+// RemoveDead removes a dead job for good
+func (c *Catapult) RemoveDead(id string) (err error) {
+	job, err := c.getDeadJob(id)
+	if err != nil || job == nil {
+		return
+	}
+	_, err = c.store.ZRem(c.getKeyForDeadQueue(job.QueueName), id)
+	if err != nil {
+		return
+	}
+	err = c.store.Delete(c.getKeyForDeadJob(id), c.getKeyForResult(id))
+	if err != nil {
+		return
+	}
+	err = c.forget(id)
+	return
+}
+
+// Private functions
+
+// fail handles a failed attempt of a job, either retrying it later or moving it to the dead-letter queue
+func (c *Catapult) fail(ctx context.Context, job *queue.Job, cause error) {
+	now := time.Now()
+	job.Errors = append(job.Errors, queue.JobError{
+		Attempt: job.Attempt,
+		Error:   cause.Error(),
+		At:      now,
+	})
+	policy := c.getRetryPolicy(job)
+	// Without a policy, redeliver the job right away
+	if policy == nil {
+		c.transition(job, queue.StateFailed)
+		_ = c.nack(ctx, job.MessageID)
+		return
+	}
+	id := job.MessageID
+	var err error
+	if policy.Exhausted(job.Attempt) {
+		err = c.bury(job)
+		if err == nil {
+			c.unalias(job)
+			c.release(job)
+			c.transition(job, queue.StateDead)
+			c.getMetrics().JobDead(job.QueueName)
+			c.saveResult(job, nil, cause)
+			c.emit(EventDead, job, cause)
+		}
+	} else {
+		// Push the next attempt, due after the backoff, keeping the id of the job
+		retry := *job
+		retry.ETA = now.Add(policy.NextDelay(job.Attempt))
+		retry.UpdatedAt = now
+		retry.Attempt++
+		err = c.enqueue(&retry)
+		if err == nil {
+			c.transition(&retry, queue.StateFailed)
+			c.getMetrics().JobRetried(job.QueueName)
+			c.emit(EventRetried, &retry, cause)
+		}
+	}
+	// Let the job be redelivered if it could not be moved
+	if err != nil {
+		c.log().Log(logger.LevelError, "job retry failed", jobFields(job, logger.F("error", err))...)
+		_ = c.nack(ctx, id)
+		return
+	}
+	_ = c.ack(ctx, id)
+}
+
+// bury moves a job to the dead-letter queue
+func (c *Catapult) bury(job *queue.Job) (err error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	err = c.store.Set(c.getKeyForDeadJob(job.ID), string(data), 0)
+	if err != nil {
+		return
+	}
+	err = c.store.ZAdd(c.getKeyForDeadQueue(job.QueueName), float64(toMillis(time.Now())), job.ID)
+	return
+}
+
+func (c *Catapult) getDeadJob(id string) (job *queue.Job, err error) {
+	data, err := c.store.Get(c.getKeyForDeadJob(id))
+	if err != nil || data == "" {
+		return
+	}
+	job = &queue.Job{}
+	err = json.Unmarshal([]byte(data), job)
+	if err != nil {
+		return
+	}
+	err = c.withState(job)
+	return
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (c *Catapult) getRetryPolicy(job *queue.Job) *queue.RetryPolicy {
+	if job.Retry != nil {
+		return job.Retry
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.retries[job.QueueName]
+}
+
+func (c *Catapult) getKeyForDeadJob(id string) string {
+	return "dead:job:" + id
+}
+
+func (c *Catapult) getKeyForDeadQueue(queueName string) string {
+	return "dead:q:" + queueName
+}
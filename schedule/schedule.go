@@ -0,0 +1,222 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidExpression is the error for a cron expression that cannot be parsed
+var ErrInvalidExpression = errors.New("Schedule Error: invalid cron expression!")
+
+// ErrInvalidInterval is the error for an interval that is not positive
+var ErrInvalidInterval = errors.New("Schedule Error: interval must be positive!")
+
+// Schedule is a schedule of recurring occurrences
+type Schedule interface {
+	// Next gets the first occurrence strictly after t, or zero time if there is none
+	Next(t time.Time) time.Time
+}
+
+// Interval is a schedule occurring at a fixed interval
+//
+// The occurrences are aligned to multiples of the interval, so that every process
+// agrees on them.
+type Interval time.Duration
+
+// Every creates a schedule occurring at a fixed interval
+func Every(interval time.Duration) (Interval, error) {
+	if interval <= 0 {
+		return 0, ErrInvalidInterval
+	}
+	return Interval(interval), nil
+}
+
+// Next gets the first occurrence after t
+func (i Interval) Next(t time.Time) time.Time {
+	d := time.Duration(i)
+	return t.Truncate(d).Add(d)
+}
+
+// Cron is a schedule defined by a cron expression
+type Cron struct {
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domStar  bool // whether the day of month is unrestricted
+	dowStar  bool // whether the day of week is unrestricted
+	location *time.Location
+}
+
+// cronField is the range of a field of a cron expression
+type cronField struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// descriptors are the shorthands for common cron expressions
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a standard five field cron expression (minute, hour, day of
+// month, month, day of week), evaluated in the location
+//
+// Each field accepts *, numbers, names of months and days, ranges (a-b), lists
+// (a,b) and steps (*/n, a-b/n). The @yearly, @monthly, @weekly, @daily and
+// @hourly shorthands are accepted as well. As in cron, when both the day of
+// month and the day of week are restricted, a day matching either one matches.
+func ParseCron(expr string, location *time.Location) (*Cron, error) {
+	if location == nil {
+		location = time.UTC
+	}
+	expr = strings.TrimSpace(expr)
+	if descriptor, exists := descriptors[strings.ToLower(expr)]; exists {
+		expr = descriptor
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ErrInvalidExpression
+	}
+	c := &Cron{
+		domStar:  strings.HasPrefix(fields[2], "*"),
+		dowStar:  strings.HasPrefix(fields[4], "*"),
+		location: location,
+	}
+	var err error
+	if c.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// Next gets the first occurrence after t
+func (c *Cron) Next(t time.Time) time.Time {
+	original := t.Location()
+	t = t.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	// Give up if nothing matches within five years, e.g. for February 30th
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t.In(original)
+	}
+	return time.Time{}
+}
+
+// Private functions
+
+func (c *Cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	// An unrestricted day field leaves the decision to the other one
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func parseField(field string, bounds cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		// Split off the step
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, ErrInvalidExpression
+			}
+			part = part[:i]
+		}
+		// Parse the range
+		low, high := bounds.min, bounds.max
+		if part != "*" {
+			bound := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = parseValue(bound[0], bounds); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bound) == 2 {
+				if high, err = parseValue(bound[1], bounds); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// a/n runs from a to the end of the range
+				high = bounds.max
+			}
+		}
+		if low > high {
+			return 0, ErrInvalidExpression
+		}
+		for i := low; i <= high; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(value string, bounds cronField) (int, error) {
+	if n, exists := bounds.names[strings.ToLower(value)]; exists {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < bounds.min || n > bounds.max {
+		return 0, ErrInvalidExpression
+	}
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func at(value string) time.Time {
+	t, _ := time.Parse("2006-01-02 15:04", value)
+	return t
+}
+
+func TestEvery(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Every(0)
+	assert.Equal(ErrInvalidInterval, err)
+	every, err := Every(15 * time.Minute)
+	assert.Empty(err)
+	assert.Equal(at("2016-06-01 10:15"), every.Next(at("2016-06-01 10:07")))
+	assert.Equal(at("2016-06-01 10:30"), every.Next(at("2016-06-01 10:15")))
+}
+
+func TestParseCron(t *testing.T) {
+	assert := assert.New(t)
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := ParseCron(expr, nil)
+		assert.Equal(ErrInvalidExpression, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		expr string
+		from string
+		next string
+	}{
+		{"* * * * *", "2016-06-01 10:07", "2016-06-01 10:08"},
+		{"*/15 * * * *", "2016-06-01 10:07", "2016-06-01 10:15"},
+		{"0 9 * * *", "2016-06-01 10:07", "2016-06-02 09:00"},
+		{"30 8-10/2 * * *", "2016-06-01 09:00", "2016-06-01 10:30"},
+		{"0 0 1 * *", "2016-06-01 10:07", "2016-07-01 00:00"},
+		{"0 0 * * mon", "2016-06-01 10:07", "2016-06-06 00:00"},
+		{"0 0 * * 7", "2016-06-01 10:07", "2016-06-05 00:00"},
+		{"0 0 13 * fri", "2016-06-01 10:07", "2016-06-03 00:00"},
+		{"0 0 29 feb *", "2016-06-01 10:07", "2020-02-29 00:00"},
+		{"@hourly", "2016-06-01 10:07", "2016-06-01 11:00"},
+		{"0 12 1,15 jan-mar *", "2016-06-01 10:07", "2017-01-01 12:00"},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr, time.UTC)
+		assert.Empty(err, c.expr)
+		assert.Equal(at(c.next), cron.Next(at(c.from)), c.expr)
+	}
+	// Impossible dates never occur
+	cron, err := ParseCron("0 0 30 feb *", time.UTC)
+	assert.Empty(err)
+	assert.True(cron.Next(at("2016-06-01 10:07")).IsZero())
+}
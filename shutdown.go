@@ -0,0 +1,145 @@
+package catapult
+
+import (
+	"context"
+	"sync"
+
+	"catapult/lock"
+	"catapult/queue"
+)
+
+// Shutdown shuts down the catapult gracefully
+//
+// Fetching stops right away, and the running jobs are given until ctx is done to
+// finish. The jobs still running then are cancelled and nacked, so that they are
+// redelivered right away, and their locks are released. The connections are
+// closed last. The error of ctx is returned if any job had to be given up.
+func (c *Catapult) Shutdown(ctx context.Context) (err error) {
+	c.shutdown.Lock()
+	defer c.shutdown.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+		close(c.closed)
+	}
+	// Stop fetching
+	processors := c.listProcessors()
+	for _, p := range processors {
+		p.drain()
+	}
+	// Wait for the running jobs to finish
+	done := make(chan struct{})
+	go func() {
+		for _, p := range processors {
+			<-p.stopped
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Give up on the jobs still running
+		for _, p := range processors {
+			p.cancel()
+		}
+		c.abandon()
+	}
+	// Wait for the fetches still running to give their jobs back
+	fetched := make(chan struct{})
+	go func() {
+		for _, p := range processors {
+			p.fetches.Wait()
+		}
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-ctx.Done():
+	}
+	c.background.Wait()
+	c.broadcasting.Lock()
+	c.stopBroadcast()
+	c.broadcasting.Unlock()
+	c.broker.Close()
+	if c.rClient != nil {
+		c.rClient.Close()
+	}
+	return
+}
+
+// Private functions
+
+// task is a job being processed, which is settled exactly once: by the worker
+// processing it, or by a shutdown giving up on it
+type task struct {
+	ctx     context.Context // context of the trace of the job
+	job     *queue.Job
+	lock    *lock.Lock
+	mutex   sync.Mutex
+	settled bool
+	release sync.Once
+}
+
+// settle claims the right to ack or nack the job, returning false if it was already claimed
+func (t *task) settle() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.settled {
+		return false
+	}
+	t.settled = true
+	return true
+}
+
+// unlock releases the lock on the job once
+func (t *task) unlock() {
+	t.release.Do(t.lock.Release)
+}
+
+// track registers a job being processed under its lock
+func (c *Catapult) track(ctx context.Context, job *queue.Job, l *lock.Lock) *task {
+	t := &task{ctx: ctx, job: job, lock: l}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tasks[t] = struct{}{}
+	return t
+}
+
+// untrack unregisters a job once processed and releases its lock
+func (c *Catapult) untrack(t *task) {
+	c.mutex.Lock()
+	delete(c.tasks, t)
+	c.mutex.Unlock()
+	t.unlock()
+}
+
+// abandon nacks the jobs still being processed and releases their locks
+func (c *Catapult) abandon() {
+	c.mutex.Lock()
+	tasks := make([]*task, 0, len(c.tasks))
+	for t := range c.tasks {
+		tasks = append(tasks, t)
+	}
+	c.mutex.Unlock()
+	for _, t := range tasks {
+		if t.settle() {
+			// Leave the job of the handler alone, as it may still be running
+			job := *t.job
+			c.transition(&job, queue.StateScheduled)
+			_ = c.nack(t.ctx, t.job.MessageID)
+		}
+		t.unlock()
+	}
+}
+
+func (c *Catapult) listProcessors() []*processor {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	processors := make([]*processor, 0, len(c.processors))
+	for _, p := range c.processors {
+		processors = append(processors, p)
+	}
+	return processors
+}
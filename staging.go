@@ -0,0 +1,164 @@
+package catapult
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+)
+
+var (
+	// StagingHorizon is how far ahead of their ETA jobs are handed to the broker
+	//
+	// Jobs due later are staged in the store until they come within range, as
+	// brokers such as disque cannot hold jobs past their TTL.
+	StagingHorizon = 12 * time.Hour
+	// StagingInterval is the interval between promotions of the staged jobs
+	StagingInterval = time.Second
+	// StagingBatch is the maximum number of staged jobs promoted at a time
+	StagingBatch = 100
+)
+
+// Private functions
+
+// enqueue hands a job to the broker, or stages it if it is due beyond the horizon
+func (c *Catapult) enqueue(job *queue.Job) (err error) {
+	if job.ETA.Sub(time.Now()) > StagingHorizon {
+		err = c.stage(job)
+		return
+	}
+	err = queue.PushJob(c.broker, job)
+	if err != nil {
+		return
+	}
+	err = c.alias(job)
+	if err != nil {
+		_ = queue.RemoveJob(c.broker, job.MessageID)
+	}
+	return
+}
+
+// stage keeps a job in the store, scored by its ETA, until it is promoted
+func (c *Catapult) stage(job *queue.Job) (err error) {
+	if job.ID == "" {
+		job.ID, err = newJobID("S")
+		if err != nil {
+			return
+		}
+	}
+	job.MessageID = ""
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	err = c.store.Set(c.getKeyForStagedJob(job.ID), string(data), 0)
+	if err != nil {
+		return
+	}
+	err = c.store.ZAdd(c.getKeyForStaging(), float64(toMillis(job.ETA)), job.ID)
+	return
+}
+
+// unstage removes a job from the stage
+func (c *Catapult) unstage(id string) (err error) {
+	_, err = c.store.ZRem(c.getKeyForStaging(), id)
+	if err != nil {
+		return
+	}
+	err = c.store.Delete(c.getKeyForStagedJob(id))
+	return
+}
+
+func (c *Catapult) getStagedJob(id string) (job *queue.Job, err error) {
+	data, err := c.store.Get(c.getKeyForStagedJob(id))
+	if err != nil || data == "" {
+		return
+	}
+	job = &queue.Job{}
+	err = json.Unmarshal([]byte(data), job)
+	return
+}
+
+func (c *Catapult) runPromoter() {
+	defer c.background.Done()
+	ticker := time.NewTicker(StagingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.promote(now)
+		}
+	}
+}
+
+// promote hands the staged jobs coming within the horizon to the broker
+func (c *Catapult) promote(now time.Time) {
+	until := float64(toMillis(now.Add(StagingHorizon)))
+	ids, err := c.store.ZRangeByScore(c.getKeyForStaging(), math.Inf(-1), until, 0, StagingBatch)
+	if err != nil {
+		c.log().Log(logger.LevelError, "staged jobs listing failed", logger.F("error", err))
+		return
+	}
+	for _, id := range ids {
+		if err := c.promoteJob(id); err != nil {
+			c.log().Log(logger.LevelError, "staged job promotion failed", logger.F("job", id), logger.F("error", err))
+		}
+	}
+}
+
+// promoteJob hands a staged job to the broker, keeping its id
+func (c *Catapult) promoteJob(id string) (err error) {
+	// Acquire a lock on the job, so that it is not rescheduled meanwhile
+	l := c.newLock(c.prefix+id, false)
+	l.MaxAttempts = 1
+	result, err := l.Get()
+	if err != nil || !result {
+		return
+	}
+	defer l.Release()
+	// Claim the job so that it is only promoted once
+	removed, err := c.store.ZRem(c.getKeyForStaging(), id)
+	if err != nil || !removed {
+		return
+	}
+	job, err := c.getStagedJob(id)
+	if err != nil || job == nil {
+		return
+	}
+	err = queue.PushJob(c.broker, job)
+	if err == nil {
+		err = c.alias(job)
+		if err != nil {
+			_ = queue.RemoveJob(c.broker, job.MessageID)
+		}
+	}
+	if err != nil {
+		// Put it back on the stage
+		_ = c.store.ZAdd(c.getKeyForStaging(), float64(toMillis(job.ETA)), id)
+		return
+	}
+	// Drop the job again if it was removed while being promoted
+	data, err := c.store.Get(c.getKeyForStagedJob(id))
+	if err != nil {
+		return
+	}
+	if data == "" {
+		_ = queue.RemoveJob(c.broker, job.MessageID)
+		c.unalias(job)
+		return
+	}
+	err = c.store.Delete(c.getKeyForStagedJob(id))
+	return
+}
+
+func (c *Catapult) getKeyForStagedJob(id string) string {
+	return "staged:job:" + id
+}
+
+func (c *Catapult) getKeyForStaging() string {
+	return "staged"
+}
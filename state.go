@@ -0,0 +1,211 @@
+package catapult
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"catapult/logger"
+	"catapult/queue"
+	"catapult/store"
+)
+
+// Inspect gets the record of a job in any state, including jobs that are done
+//
+// The record is a snapshot of the job taken at its last transition, with the
+// timestamps of all its transitions. Records of completed jobs are kept for
+// ResultTTL, those of jobs with a TTL until the broker may have dropped them, and
+// those of removed jobs are dropped.
+func (c *Catapult) Inspect(id string) (job *queue.Job, err error) {
+	job, err = c.getJobRecord(id)
+	if err != nil || job == nil {
+		return
+	}
+	job.State = job.State.At(job.ETA, time.Now())
+	return
+}
+
+// Private functions
+
+// stateNone is the state of a job without a record
+const stateNone queue.State = ""
+
+// dropMargin is how long past their TTL the jobs dropped by the broker are accounted for
+var dropMargin = time.Minute
+
+// transitionAttempts is the number of times a transition is tried when the record of
+// the job is changed underneath it
+var transitionAttempts = 5
+
+// transition moves a job to the state, keeping a record of the job in the store
+//
+// The record is indexed per queue and state: pending and active jobs by their ETA,
+// and jobs that are done by when they were done. Moves the state machine does not
+// allow, e.g. those of a stale message, are ignored, and so are moves from a state
+// other than those given, if any. The record and its index are updated at once, and
+// the move is tried again on the new record if another one came first.
+//
+// Completed jobs are kept for ResultTTL, like their results. Dead jobs are kept until
+// removed, and jobs on their way for as long as the broker may keep them.
+func (c *Catapult) transition(job *queue.Job, state queue.State, from ...queue.State) {
+	transitions := job.Transitions
+	var err error
+	for i := 0; i < transitionAttempts; i++ {
+		job.Transitions = transitions
+		var done bool
+		done, err = c.tryTransition(job, state, from)
+		if done || err != nil {
+			break
+		}
+	}
+	if err != nil {
+		c.log().Log(logger.LevelError, "job state update failed", jobFields(job, logger.F("state", state), logger.F("error", err))...)
+	}
+}
+
+// tryTransition moves a job to the state unless its record changed since it was read,
+// returning whether the move is done with, either made or ignored
+func (c *Catapult) tryTransition(job *queue.Job, state queue.State, from []queue.State) (done bool, err error) {
+	now := time.Now()
+	key := c.getKeyForJobRecord(job.ID)
+	data, err := c.store.Get(key)
+	if err != nil {
+		return
+	}
+	var previous *queue.Job
+	if data != "" {
+		previous = &queue.Job{}
+		err = json.Unmarshal([]byte(data), previous)
+		if err != nil {
+			return
+		}
+	}
+	if !canMove(previous, state, from) {
+		done = true
+		return
+	}
+	move := store.Move{
+		Member: job.ID,
+		To:     c.getKeyForState(job.QueueName, state),
+		Score:  float64(toMillis(job.ETA)),
+	}
+	if previous != nil {
+		move.From = c.getKeyForState(previous.QueueName, previous.State)
+		job.Transitions = previous.Transitions
+		// Record when the job was queued on its way to a worker
+		if previous.State == queue.StateScheduled && state == queue.StateActive {
+			queued := previous.ETA
+			if queued.After(now) {
+				queued = now
+			}
+			job.Transitions = append(job.Transitions, queue.Transition{State: queue.StateQueued, At: queued})
+		}
+	}
+	job.State = state
+	job.Transitions = append(job.Transitions, queue.Transition{State: state, At: now})
+	if state == queue.StateCompleted || state == queue.StateDead {
+		move.Score = float64(toMillis(now))
+	}
+	record, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	var ttl time.Duration
+	switch state {
+	case queue.StateCompleted:
+		ttl = ResultTTL
+	case queue.StateDead:
+	default:
+		ttl = dropTTL(job, now)
+	}
+	done, err = c.store.CompareAndSet(key, data, string(record), ttl, move)
+	if !done || err != nil {
+		return
+	}
+	if previous == nil {
+		c.tag(job)
+	}
+	// Drop the completed jobs whose records expired
+	if state == queue.StateCompleted {
+		_, _ = c.store.ZRemRangeByScore(move.To, math.Inf(-1), float64(toMillis(now.Add(-ResultTTL))))
+	}
+	return
+}
+
+// forget drops the record of a job that is removed
+func (c *Catapult) forget(id string) (err error) {
+	record, err := c.getJobRecord(id)
+	if err != nil || record == nil {
+		return
+	}
+	_, err = c.store.ZRem(c.getKeyForState(record.QueueName, record.State), id)
+	if err != nil {
+		return
+	}
+	c.untag(record)
+	err = c.store.Delete(c.getKeyForJobRecord(id))
+	return
+}
+
+// withState sets the state of a job as recorded
+func (c *Catapult) withState(job *queue.Job) (err error) {
+	record, err := c.getJobRecord(job.ID)
+	if err != nil || record == nil {
+		return
+	}
+	job.State = record.State.At(job.ETA, time.Now())
+	job.Transitions = record.Transitions
+	return
+}
+
+func (c *Catapult) getJobRecord(id string) (job *queue.Job, err error) {
+	data, err := c.store.Get(c.getKeyForJobRecord(id))
+	if err != nil || data == "" {
+		return
+	}
+	job = &queue.Job{}
+	err = json.Unmarshal([]byte(data), job)
+	return
+}
+
+func (c *Catapult) getKeyForJobRecord(id string) string {
+	return "state:job:" + id
+}
+
+func (c *Catapult) getKeyForState(queueName string, state queue.State) string {
+	return "state:" + queueName + ":" + string(state)
+}
+
+// canMove tells whether a job recorded as previous, nil if it has no record, can move
+// to the state, from one of the states if any are given
+func canMove(previous *queue.Job, state queue.State, from []queue.State) bool {
+	current := stateNone
+	if previous != nil {
+		current = previous.State
+		if !current.CanTransition(state) {
+			return false
+		}
+	}
+	if len(from) == 0 {
+		return true
+	}
+	for _, s := range from {
+		if s == current {
+			return true
+		}
+	}
+	return false
+}
+
+// dropTTL is how long a job may be kept by the broker past now, with a margin, or 0
+// if it is kept until processed
+func dropTTL(job *queue.Job, now time.Time) time.Duration {
+	if job.Push == nil || job.Push.TTL <= 0 {
+		return 0
+	}
+	due := job.ETA
+	if due.Before(now) {
+		due = now
+	}
+	return due.Sub(now) + job.Push.TTL + dropMargin
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySubscriberBuffer is the number of unread messages kept for a subscriber
+const memorySubscriberBuffer = 64
+
+// memorySweepInterval is the interval between sweeps of the expired values, which
+// are dropped on writes so that keys never read again do not pile up
+var memorySweepInterval = time.Minute
+
+// MemoryStore keeps the bookkeeping in process memory
+type MemoryStore struct {
+	mutex       sync.Mutex
+	values      map[string]memoryValue
+	sets        map[string]map[string]float64
+	subscribers map[string]map[chan string]struct{}
+	swept       time.Time // last time the expired values were swept
+}
+
+type memoryValue struct {
+	value string
+	until time.Time // zero if the value does not expire
+}
+
+// NewMemoryStore creates an in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values:      make(map[string]memoryValue),
+		sets:        make(map[string]map[string]float64),
+		subscribers: make(map[string]map[chan string]struct{}),
+	}
+}
+
+// Get gets the value of a key
+func (s *MemoryStore) Get(key string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, exists := s.get(key)
+	if !exists {
+		return "", nil
+	}
+	return value.value, nil
+}
+
+// Set sets the value of a key
+func (s *MemoryStore) Set(key string, value string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(key, value, ttl)
+	return nil
+}
+
+// SetNX sets the value of a key if it does not exist
+func (s *MemoryStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.get(key); exists {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+	return true, nil
+}
+
+// Incr increments the integer value of a key
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, exists := s.get(key)
+	if !exists {
+		s.set(key, "1", ttl)
+		return 1, nil
+	}
+	n, err := strconv.Atoi(value.value)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	value.value = strconv.Itoa(n)
+	s.values[key] = value
+	return n, nil
+}
+
+// Delete removes the keys
+func (s *MemoryStore) Delete(keys ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range keys {
+		delete(s.values, key)
+		delete(s.sets, key)
+	}
+	return nil
+}
+
+// CompareAndSet sets the value of a key if it still has the old value, and makes the moves
+func (s *MemoryStore) CompareAndSet(key string, old string, value string, ttl time.Duration, moves ...Move) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, exists := s.get(key)
+	if !exists {
+		current.value = ""
+	}
+	if current.value != old {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+	for _, move := range moves {
+		if move.From != "" {
+			s.zrem(move.From, move.Member)
+		}
+		s.zadd(move.To, move.Score, move.Member)
+	}
+	return true, nil
+}
+
+// ZAdd adds a member to a sorted set
+func (s *MemoryStore) ZAdd(key string, score float64, member string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.zadd(key, score, member)
+	return nil
+}
+
+// ZRem removes a member from a sorted set
+func (s *MemoryStore) ZRem(key string, member string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.zrem(key, member), nil
+}
+
+// ZRangeByScore gets the members with scores between min and max
+func (s *MemoryStore) ZRangeByScore(key string, min float64, max float64, offset int, count int) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members := s.zrange(key, min, max)
+	if offset >= len(members) {
+		return []string{}, nil
+	}
+	members = members[offset:]
+	if count >= 0 && count < len(members) {
+		members = members[:count]
+	}
+	return members, nil
+}
+
+// ZCount counts the members with scores between min and max
+func (s *MemoryStore) ZCount(key string, min float64, max float64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.zrange(key, min, max)), nil
+}
+
+// ZRemRangeByScore removes the members with scores between min and max
+func (s *MemoryStore) ZRemRangeByScore(key string, min float64, max float64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members := s.zrange(key, min, max)
+	set := s.sets[key]
+	for _, member := range members {
+		delete(set, member)
+	}
+	if len(set) == 0 {
+		delete(s.sets, key)
+	}
+	return len(members), nil
+}
+
+// Publish sends a message to the subscribers of a channel
+//
+// Like a redis client that falls behind, a subscriber with too many unread messages
+// misses the message.
+func (s *MemoryStore) Publish(channel string, message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for messages := range s.subscribers[channel] {
+		select {
+		case messages <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to a channel
+func (s *MemoryStore) Subscribe(channel string) (<-chan string, func(), error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages := make(chan string, memorySubscriberBuffer)
+	subscribers, exists := s.subscribers[channel]
+	if !exists {
+		subscribers = make(map[chan string]struct{})
+		s.subscribers[channel] = subscribers
+	}
+	subscribers[messages] = struct{}{}
+	cancel := func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, subscribed := subscribers[messages]; !subscribed {
+			return
+		}
+		delete(subscribers, messages)
+		if len(subscribers) == 0 {
+			delete(s.subscribers, channel)
+		}
+		close(messages)
+	}
+	return messages, cancel, nil
+}
+
+// Private functions
+
+func (s *MemoryStore) get(key string) (memoryValue, bool) {
+	value, exists := s.values[key]
+	if exists && !value.until.IsZero() && !time.Now().Before(value.until) {
+		delete(s.values, key)
+		return value, false
+	}
+	return value, exists
+}
+
+func (s *MemoryStore) set(key string, value string, ttl time.Duration) {
+	now := time.Now()
+	v := memoryValue{
+		value: value,
+	}
+	if ttl > 0 {
+		v.until = now.Add(ttl)
+	}
+	s.values[key] = v
+	if now.Sub(s.swept) >= memorySweepInterval {
+		s.sweep(now)
+	}
+}
+
+// sweep drops the expired values
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, value := range s.values {
+		if !value.until.IsZero() && !now.Before(value.until) {
+			delete(s.values, key)
+		}
+	}
+	s.swept = now
+}
+
+func (s *MemoryStore) zadd(key string, score float64, member string) {
+	set, exists := s.sets[key]
+	if !exists {
+		set = make(map[string]float64)
+		s.sets[key] = set
+	}
+	set[member] = score
+}
+
+func (s *MemoryStore) zrem(key string, member string) bool {
+	set := s.sets[key]
+	if _, exists := set[member]; !exists {
+		return false
+	}
+	delete(set, member)
+	if len(set) == 0 {
+		delete(s.sets, key)
+	}
+	return true
+}
+
+// zrange gets the members with scores between min and max, ordered like redis does
+func (s *MemoryStore) zrange(key string, min float64, max float64) []string {
+	set := s.sets[key]
+	members := make([]string, 0, len(set))
+	for member, score := range set {
+		if score >= min && score <= max {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := set[members[i]], set[members[j]]
+		if a != b {
+			return a < b
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryValues(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	value, err := s.Get("missing")
+	assert.Empty(err)
+	assert.Empty(value)
+	assert.Empty(s.Set("key", "value", 100*time.Millisecond))
+	set, err := s.SetNX("key", "other", 0)
+	assert.Empty(err)
+	assert.False(set)
+	value, err = s.Get("key")
+	assert.Empty(err)
+	assert.Equal("value", value)
+	// Values expire after the ttl
+	time.Sleep(100 * time.Millisecond)
+	set, err = s.SetNX("key", "other", 0)
+	assert.Empty(err)
+	assert.True(set)
+	assert.Empty(s.Delete("key"))
+	value, err = s.Get("key")
+	assert.Empty(err)
+	assert.Empty(value)
+}
+
+func TestMemoryIncr(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	n, err := s.Incr("counter", 100*time.Millisecond)
+	assert.Empty(err)
+	assert.Equal(1, n)
+	n, err = s.Incr("counter", 100*time.Millisecond)
+	assert.Empty(err)
+	assert.Equal(2, n)
+	// The counter expires after the ttl from when it was created
+	time.Sleep(100 * time.Millisecond)
+	n, err = s.Incr("counter", 0)
+	assert.Empty(err)
+	assert.Equal(1, n)
+}
+
+func TestMemorySweep(t *testing.T) {
+	assert := assert.New(t)
+	interval := memorySweepInterval
+	memorySweepInterval = 50 * time.Millisecond
+	defer func() {
+		memorySweepInterval = interval
+	}()
+	s := NewMemoryStore()
+	// Expired values are dropped on writes even if never read again
+	for i := 0; i < 10; i++ {
+		_, err := s.Incr("rate:"+strconv.Itoa(i), 10*time.Millisecond)
+		assert.Empty(err)
+	}
+	assert.Empty(s.Set("kept", "value", 0))
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(s.Set("other", "value", time.Hour))
+	s.mutex.Lock()
+	assert.Len(s.values, 2)
+	s.mutex.Unlock()
+}
+
+func TestMemorySortedSets(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	assert.Empty(s.ZAdd("set", 3, "c"))
+	assert.Empty(s.ZAdd("set", 1, "a"))
+	assert.Empty(s.ZAdd("set", 2, "b"))
+	members, err := s.ZRangeByScore("set", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"a", "b", "c"}, members)
+	members, err = s.ZRangeByScore("set", 2, 3, 1, 1)
+	assert.Empty(err)
+	assert.Equal([]string{"c"}, members)
+	count, err := s.ZCount("set", 1, 2)
+	assert.Empty(err)
+	assert.Equal(2, count)
+	removed, err := s.ZRem("set", "b")
+	assert.Empty(err)
+	assert.True(removed)
+	removed, err = s.ZRem("set", "b")
+	assert.Empty(err)
+	assert.False(removed)
+	n, err := s.ZRemRangeByScore("set", math.Inf(-1), 1)
+	assert.Empty(err)
+	assert.Equal(1, n)
+	members, err = s.ZRangeByScore("set", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"c"}, members)
+}
+
+func TestMemoryCompareAndSet(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	// The value is only set if the key does not exist yet
+	set, err := s.CompareAndSet("key", "", "first", 0, Move{Member: "m", To: "a", Score: 1})
+	assert.Empty(err)
+	assert.True(set)
+	set, err = s.CompareAndSet("key", "", "again", 0, Move{Member: "m", To: "b", Score: 1})
+	assert.Empty(err)
+	assert.False(set)
+	// then only if it still has the old value, moving the member along with it
+	set, err = s.CompareAndSet("key", "stale", "second", 0, Move{Member: "m", From: "a", To: "b", Score: 2})
+	assert.Empty(err)
+	assert.False(set)
+	set, err = s.CompareAndSet("key", "first", "second", 100*time.Millisecond, Move{Member: "m", From: "a", To: "b", Score: 2})
+	assert.Empty(err)
+	assert.True(set)
+	value, err := s.Get("key")
+	assert.Empty(err)
+	assert.Equal("second", value)
+	members, err := s.ZRangeByScore("a", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Empty(members)
+	members, err = s.ZRangeByScore("b", 2, 2, 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"m"}, members)
+	// The value expires after the ttl
+	time.Sleep(100 * time.Millisecond)
+	set, err = s.CompareAndSet("key", "", "third", 0)
+	assert.Empty(err)
+	assert.True(set)
+}
+
+func TestMemoryPubSub(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	messages, cancel, err := s.Subscribe("channel")
+	assert.Empty(err)
+	assert.Empty(s.Publish("channel", "hello"))
+	assert.Empty(s.Publish("other", "ignored"))
+	assert.Equal("hello", <-messages)
+	// Messages are closed once the subscription ends
+	cancel()
+	cancel()
+	_, open := <-messages
+	assert.False(open)
+	assert.Empty(s.Publish("channel", "nobody"))
+}
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultRedisPrefix is the default prefix of the redis store keys
+const DefaultRedisPrefix = "ctp:"
+
+// RedisStore keeps the bookkeeping in redis
+type RedisStore struct {
+	Client *redis.Pool // the redis client
+	Prefix string      // prefix of the keys
+}
+
+// NewRedisStore creates a store on a redis pool
+func NewRedisStore(client *redis.Pool) *RedisStore {
+	return &RedisStore{
+		Client: client,
+		Prefix: DefaultRedisPrefix,
+	}
+}
+
+// Get gets the value of a key
+func (s *RedisStore) Get(key string) (string, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	value, err := redis.String(conn.Do("GET", s.Prefix+key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return value, err
+}
+
+// Set sets the value of a key
+func (s *RedisStore) Set(key string, value string, ttl time.Duration) (err error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	if ttl > 0 {
+		_, err = conn.Do("SET", s.Prefix+key, value, "PX", toMillis(ttl))
+	} else {
+		_, err = conn.Do("SET", s.Prefix+key, value)
+	}
+	return
+}
+
+// SetNX sets the value of a key if it does not exist
+func (s *RedisStore) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	var reply string
+	var err error
+	if ttl > 0 {
+		reply, err = redis.String(conn.Do("SET", s.Prefix+key, value, "NX", "PX", toMillis(ttl)))
+	} else {
+		reply, err = redis.String(conn.Do("SET", s.Prefix+key, value, "NX"))
+	}
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+// Incr increments the integer value of a key
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	return redis.Int(redisIncr.Do(conn, s.Prefix+key, toMillis(ttl)))
+}
+
+// Delete removes the keys
+func (s *RedisStore) Delete(keys ...string) (err error) {
+	if len(keys) == 0 {
+		return
+	}
+	conn := s.Client.Get()
+	defer conn.Close()
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = s.Prefix + key
+	}
+	_, err = conn.Do("DEL", args...)
+	return
+}
+
+// CompareAndSet sets the value of a key if it still has the old value, and makes the moves
+func (s *RedisStore) CompareAndSet(key string, old string, value string, ttl time.Duration, moves ...Move) (bool, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	keys := []interface{}{s.Prefix + key}
+	args := []interface{}{old, value, toMillis(ttl)}
+	for _, move := range moves {
+		// Removing the member from the set it is added to changes nothing
+		from := move.From
+		if from == "" {
+			from = move.To
+		}
+		keys = append(keys, s.Prefix+from, s.Prefix+move.To)
+		args = append(args, move.Member, formatScore(move.Score))
+	}
+	set, err := redis.Int(redisCompareAndSet.Do(conn, append(append([]interface{}{len(keys)}, keys...), args...)...))
+	return set == 1, err
+}
+
+// ZAdd adds a member to a sorted set
+func (s *RedisStore) ZAdd(key string, score float64, member string) (err error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	_, err = conn.Do("ZADD", s.Prefix+key, formatScore(score), member)
+	return
+}
+
+// ZRem removes a member from a sorted set
+func (s *RedisStore) ZRem(key string, member string) (bool, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	removed, err := redis.Int(conn.Do("ZREM", s.Prefix+key, member))
+	return removed > 0, err
+}
+
+// ZRangeByScore gets the members with scores between min and max
+func (s *RedisStore) ZRangeByScore(key string, min float64, max float64, offset int, count int) ([]string, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", s.Prefix+key, formatScore(min), formatScore(max), "LIMIT", offset, count))
+}
+
+// ZCount counts the members with scores between min and max
+func (s *RedisStore) ZCount(key string, min float64, max float64) (int, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("ZCOUNT", s.Prefix+key, formatScore(min), formatScore(max)))
+}
+
+// ZRemRangeByScore removes the members with scores between min and max
+func (s *RedisStore) ZRemRangeByScore(key string, min float64, max float64) (int, error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("ZREMRANGEBYSCORE", s.Prefix+key, formatScore(min), formatScore(max)))
+}
+
+// Publish sends a message to the subscribers of a channel
+func (s *RedisStore) Publish(channel string, message string) (err error) {
+	conn := s.Client.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", s.Prefix+channel, message)
+	return
+}
+
+// Subscribe subscribes to a channel
+//
+// The subscription holds a connection of its own until it ends, either when it is
+// cancelled or when the connection fails.
+func (s *RedisStore) Subscribe(channel string) (<-chan string, func(), error) {
+	conn := redis.PubSubConn{Conn: s.Client.Get()}
+	err := conn.Subscribe(s.Prefix + channel)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Wait for the subscription to be confirmed, so that no message published after it is missed
+	for subscribed := false; !subscribed; {
+		switch reply := conn.Receive().(type) {
+		case redis.Subscription:
+			subscribed = reply.Kind == "subscribe"
+		case error:
+			conn.Close()
+			return nil, nil, reply
+		}
+	}
+	messages := make(chan string)
+	done := make(chan struct{})
+	// Writes to the connection are serialized, as the connection is being read from
+	var mutex sync.Mutex
+	go func() {
+		defer func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			conn.Close()
+		}()
+		defer close(messages)
+		for {
+			switch reply := conn.Receive().(type) {
+			case redis.Message:
+				select {
+				case messages <- string(reply.Data):
+				case <-done:
+				}
+			case redis.Subscription:
+				if reply.Count == 0 {
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	// End the subscription by unsubscribing, so that the reads end
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			mutex.Lock()
+			defer mutex.Unlock()
+			_ = conn.Unsubscribe()
+		})
+	}
+	return messages, cancel, nil
+}
+
+// Private functions
+
+func toMillis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func formatScore(score float64) string {
+	if math.IsInf(score, -1) {
+		return "-inf"
+	}
+	if math.IsInf(score, 1) {
+		return "+inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// Redis script for incrementing a key, setting its expiry when it is created
+var redisIncrScript = `
+  local value = redis.call("INCR", KEYS[1])
+  if value == 1 and tonumber(ARGV[1]) > 0 then
+    redis.call("PEXPIRE", KEYS[1], ARGV[1])
+  end
+  return value
+`
+var redisIncr = redis.NewScript(1, redisIncrScript)
+
+// Redis script for setting a key if it still has a value, and moving members between
+// sorted sets along with it
+var redisCompareAndSetScript = `
+  local current = redis.call("GET", KEYS[1]) or ""
+  if current ~= ARGV[1] then
+    return 0
+  end
+  if tonumber(ARGV[3]) > 0 then
+    redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+  else
+    redis.call("SET", KEYS[1], ARGV[2])
+  end
+  for i = 2, #KEYS, 2 do
+    redis.call("ZREM", KEYS[i], ARGV[i + 2])
+    redis.call("ZADD", KEYS[i + 1], ARGV[i + 3], ARGV[i + 2])
+  end
+  return 1
+`
+var redisCompareAndSet = redis.NewScript(-1, redisCompareAndSetScript)
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+var redisTestPrefix = "tq:s:"
+
+func getClient(t *testing.T) *redis.Pool {
+	client := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			// Construct connection
+			conn, err := redis.Dial("tcp", "127.0.0.1:6379")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Do("SELECT", "7"); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+	// Skip redis tests if redis is not available
+	conn := client.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		client.Close()
+		t.Skip("redis is not available: ", err)
+	}
+	return client
+}
+
+// getStore creates a redis store on keys cleared of previous runs
+func getStore(t *testing.T) *RedisStore {
+	client := getClient(t)
+	conn := client.Get()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("KEYS", redisTestPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		_, _ = conn.Do("DEL", key)
+	}
+	s := NewRedisStore(client)
+	s.Prefix = redisTestPrefix
+	return s
+}
+
+func TestRedisValues(t *testing.T) {
+	assert := assert.New(t)
+	s := getStore(t)
+	defer s.Client.Close()
+	value, err := s.Get("missing")
+	assert.Empty(err)
+	assert.Empty(value)
+	assert.Empty(s.Set("key", "value", 100*time.Millisecond))
+	set, err := s.SetNX("key", "other", 0)
+	assert.Empty(err)
+	assert.False(set)
+	value, err = s.Get("key")
+	assert.Empty(err)
+	assert.Equal("value", value)
+	// Values expire after the ttl
+	time.Sleep(150 * time.Millisecond)
+	set, err = s.SetNX("key", "other", 0)
+	assert.Empty(err)
+	assert.True(set)
+	assert.Empty(s.Delete("key"))
+	value, err = s.Get("key")
+	assert.Empty(err)
+	assert.Empty(value)
+}
+
+func TestRedisIncr(t *testing.T) {
+	assert := assert.New(t)
+	s := getStore(t)
+	defer s.Client.Close()
+	n, err := s.Incr("counter", 100*time.Millisecond)
+	assert.Empty(err)
+	assert.Equal(1, n)
+	n, err = s.Incr("counter", 100*time.Millisecond)
+	assert.Empty(err)
+	assert.Equal(2, n)
+	// The counter expires after the ttl from when it was created
+	time.Sleep(150 * time.Millisecond)
+	n, err = s.Incr("counter", 0)
+	assert.Empty(err)
+	assert.Equal(1, n)
+	// and never without one
+	conn := s.Client.Get()
+	defer conn.Close()
+	ttl, err := redis.Int(conn.Do("PTTL", redisTestPrefix+"counter"))
+	assert.Empty(err)
+	assert.Equal(-1, ttl)
+}
+
+func TestRedisCompareAndSet(t *testing.T) {
+	assert := assert.New(t)
+	s := getStore(t)
+	defer s.Client.Close()
+	// The value is only set if the key does not exist yet
+	set, err := s.CompareAndSet("key", "", "first", 0, Move{Member: "m", To: "a", Score: 1})
+	assert.Empty(err)
+	assert.True(set)
+	set, err = s.CompareAndSet("key", "", "again", 0, Move{Member: "m", To: "b", Score: 1})
+	assert.Empty(err)
+	assert.False(set)
+	// then only if it still has the old value, moving the member along with it
+	set, err = s.CompareAndSet("key", "stale", "second", 0, Move{Member: "m", From: "a", To: "b", Score: 2})
+	assert.Empty(err)
+	assert.False(set)
+	set, err = s.CompareAndSet("key", "first", "second", 100*time.Millisecond, Move{Member: "m", From: "a", To: "b", Score: 2})
+	assert.Empty(err)
+	assert.True(set)
+	value, err := s.Get("key")
+	assert.Empty(err)
+	assert.Equal("second", value)
+	members, err := s.ZRangeByScore("a", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Empty(members)
+	members, err = s.ZRangeByScore("b", 2, 2, 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"m"}, members)
+	// The value expires after the ttl
+	time.Sleep(150 * time.Millisecond)
+	set, err = s.CompareAndSet("key", "", "third", 0)
+	assert.Empty(err)
+	assert.True(set)
+}
+
+func TestRedisSortedSets(t *testing.T) {
+	assert := assert.New(t)
+	s := getStore(t)
+	defer s.Client.Close()
+	assert.Empty(s.ZAdd("set", 3, "c"))
+	assert.Empty(s.ZAdd("set", 1, "a"))
+	assert.Empty(s.ZAdd("set", 2, "b"))
+	members, err := s.ZRangeByScore("set", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"a", "b", "c"}, members)
+	members, err = s.ZRangeByScore("set", 2, 3, 1, 1)
+	assert.Empty(err)
+	assert.Equal([]string{"c"}, members)
+	count, err := s.ZCount("set", 1, 2)
+	assert.Empty(err)
+	assert.Equal(2, count)
+	removed, err := s.ZRem("set", "b")
+	assert.Empty(err)
+	assert.True(removed)
+	removed, err = s.ZRem("set", "b")
+	assert.Empty(err)
+	assert.False(removed)
+	n, err := s.ZRemRangeByScore("set", math.Inf(-1), 1)
+	assert.Empty(err)
+	assert.Equal(1, n)
+	members, err = s.ZRangeByScore("set", math.Inf(-1), math.Inf(1), 0, -1)
+	assert.Empty(err)
+	assert.Equal([]string{"c"}, members)
+}
+
+func TestRedisPubSub(t *testing.T) {
+	assert := assert.New(t)
+	s := getStore(t)
+	defer s.Client.Close()
+	messages, cancel, err := s.Subscribe("channel")
+	assert.Empty(err)
+	assert.Empty(s.Publish("channel", "hello"))
+	assert.Empty(s.Publish("other", "ignored"))
+	assert.Equal("hello", <-messages)
+	// Messages are closed once the subscription ends
+	cancel()
+	cancel()
+	_, open := <-messages
+	assert.False(open)
+	assert.Empty(s.Publish("channel", "nobody"))
+}
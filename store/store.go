@@ -0,0 +1,49 @@
+package store
+
+import (
+	"time"
+)
+
+// Store is the storage catapult keeps its bookkeeping in
+//
+// The operations mirror the redis commands of the same names, so that the
+// redis store is a thin wrapper and the memory store behaves the same way.
+type Store interface {
+	// Get gets the value of a key, returning an empty string if it does not exist
+	Get(key string) (string, error)
+	// Set sets the value of a key, expiring after ttl unless ttl is 0
+	Set(key string, value string, ttl time.Duration) error
+	// SetNX sets the value of a key if it does not exist, expiring after ttl unless ttl is 0
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	// Incr increments the integer value of a key, expiring after ttl from when it is created unless ttl is 0
+	Incr(key string, ttl time.Duration) (int, error)
+	// Delete removes the keys
+	Delete(keys ...string) error
+	// CompareAndSet sets the value of a key if it still has the old value, or does not
+	// exist if old is empty, expiring after ttl unless ttl is 0, and makes the moves
+	// along with it, all at once; returns whether the value was set
+	CompareAndSet(key string, old string, value string, ttl time.Duration, moves ...Move) (bool, error)
+	// ZAdd adds a member to a sorted set, or updates its score
+	ZAdd(key string, score float64, member string) error
+	// ZRem removes a member from a sorted set, returning whether it was there
+	ZRem(key string, member string) (bool, error)
+	// ZRangeByScore gets up to count members with scores between min and max from the offset, count < 0 for all
+	ZRangeByScore(key string, min float64, max float64, offset int, count int) ([]string, error)
+	// ZCount counts the members with scores between min and max
+	ZCount(key string, min float64, max float64) (int, error)
+	// ZRemRangeByScore removes the members with scores between min and max, returning how many were removed
+	ZRemRangeByScore(key string, min float64, max float64) (int, error)
+	// Publish sends a message to the subscribers of a channel
+	Publish(channel string, message string) error
+	// Subscribe subscribes to a channel, returning its messages and a function ending
+	// the subscription; the messages are closed once the subscription ends
+	Subscribe(channel string) (<-chan string, func(), error)
+}
+
+// Move moves a member of a sorted set to another one, with a new score
+type Move struct {
+	Member string
+	From   string // set the member is removed from, none if empty
+	To     string // set the member is added to
+	Score  float64
+}
@@ -0,0 +1,50 @@
+package catapult
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"catapult/queue"
+)
+
+// ErrJobTimeout is the error for a job whose handler ran longer than its timeout
+var ErrJobTimeout = errors.New("Catapult Error: job timed out!")
+
+// SetTimeout sets the time the jobs of a queue may run before they fail, or removes
+// it if the timeout is 0
+//
+// Once a job runs out of time, the context of its handler is cancelled, its lock is
+// released and it fails with ErrJobTimeout, to be retried per its retry policy. Jobs
+// can override the timeout of their queue when added.
+func (c *Catapult) SetTimeout(queueName string, timeout time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if timeout <= 0 {
+		delete(c.timeouts, queueName)
+		return
+	}
+	c.timeouts[queueName] = timeout
+}
+
+// Private functions
+
+// run runs the handler on a job, giving up on it once its timeout elapses
+func (c *Catapult) run(ctx context.Context, job *queue.Job, fn HandlerFunction) (value interface{}, err error) {
+	timeout := c.getTimeout(job)
+	if timeout <= 0 {
+		value, err = fn(ctx, job)
+		return
+	}
+	value, err = runWithin(ctx, job, fn, timeout, ErrJobTimeout, c.log())
+	return
+}
+
+func (c *Catapult) getTimeout(job *queue.Job) time.Duration {
+	if job.Timeout > 0 {
+		return job.Timeout
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.timeouts[job.QueueName]
+}
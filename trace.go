@@ -0,0 +1,130 @@
+package catapult
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"catapult/queue"
+)
+
+// TracerName is the name of the tracer the jobs are traced with
+const TracerName = "catapult"
+
+// SetTracerProvider sets the provider of the tracer the jobs are traced with
+//
+// Spans are exported by the exporters of the provider. By default the global
+// provider of otel is used, which is a no-op until the application sets one. A nil
+// provider goes back to the global one.
+func (c *Catapult) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tracer = tp.Tracer(TracerName)
+}
+
+// SetPropagator sets how the trace context is carried from the producers to the jobs
+//
+// By default the W3C trace context and baggage are carried. A nil propagator goes
+// back to the default.
+func (c *Catapult) SetPropagator(p propagation.TextMapPropagator) {
+	if p == nil {
+		p = defaultPropagator()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.propagator = p
+}
+
+// Private functions
+
+// startPublish starts the span of a job being added, carrying its context on the job
+func (c *Catapult) startPublish(ctx context.Context, job *queue.Job) (context.Context, trace.Span) {
+	ctx, span := c.getTracer().Start(ctx, job.QueueName+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(queueAttributes(job)...),
+	)
+	carrier := propagation.MapCarrier{}
+	c.getPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		job.Trace = carrier
+	}
+	return ctx, span
+}
+
+// startProcess starts the span of a job being processed, as a child of the span it
+// was added in
+func (c *Catapult) startProcess(ctx context.Context, job *queue.Job) (context.Context, trace.Span) {
+	return c.getTracer().Start(c.jobContext(ctx, job), job.QueueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(append(queueAttributes(job),
+			attribute.String("catapult.job.id", job.ID),
+			attribute.String("messaging.message.id", job.MessageID),
+			attribute.Int("catapult.job.attempt", job.Attempt),
+		)...),
+	)
+}
+
+// jobContext carries the trace context a job was added in on ctx
+func (c *Catapult) jobContext(ctx context.Context, job *queue.Job) context.Context {
+	if len(job.Trace) == 0 {
+		return ctx
+	}
+	return c.getPropagator().Extract(ctx, propagation.MapCarrier(job.Trace))
+}
+
+// ack acks a message in a span of the trace in ctx
+func (c *Catapult) ack(ctx context.Context, id string) (err error) {
+	_, span := c.getTracer().Start(ctx, "ack", trace.WithAttributes(attribute.String("messaging.message.id", id)))
+	defer span.End()
+	err = queue.AckJob(c.broker, id)
+	failSpan(span, err)
+	return
+}
+
+// nack nacks a message in a span of the trace in ctx
+func (c *Catapult) nack(ctx context.Context, id string) (err error) {
+	_, span := c.getTracer().Start(ctx, "nack", trace.WithAttributes(attribute.String("messaging.message.id", id)))
+	defer span.End()
+	err = queue.NackJob(c.broker, id)
+	failSpan(span, err)
+	return
+}
+
+// failSpan marks a span as failed with the error, if any
+func failSpan(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+func queueAttributes(job *queue.Job) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "catapult"),
+		attribute.String("messaging.destination.name", job.QueueName),
+	}
+}
+
+func defaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+func (c *Catapult) getTracer() trace.Tracer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tracer
+}
+
+func (c *Catapult) getPropagator() propagation.TextMapPropagator {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.propagator
+}